@@ -0,0 +1,445 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/taoh/linodego"
+)
+
+var errUsage = errors.New("usage error")
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(args []string) error
+	// dryRun commands never modify the account, regardless of the -dry-run flag.
+	dryRun bool
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{name: "create", summary: "Create a new node for the cluster", run: cmdCreate},
+		{name: "delete", args: "<node>", summary: "Delete a node of the cluster", run: cmdDelete},
+		{name: "list", summary: "List nodes of the cluster", run: cmdList},
+		{name: "import", summary: "Record existing linodes of the cluster in the local state", run: cmdImport},
+		{name: "describe", args: "<node>", summary: "Show details of a node", run: cmdDescribe},
+		{name: "reconcile", summary: "Create or delete nodes until every pool matches its count", run: cmdReconcile},
+		{name: "plan", summary: "Show the changes reconcile would make without making them", run: cmdReconcile, dryRun: true},
+		{name: "reboot", args: "<node>", summary: "Reboot a node", run: cmdReboot},
+		{name: "datacenters", summary: "List the live datacenters and the names they can be selected by", run: cmdDatacenters},
+		{name: "plans", summary: "List the live plans, their availability in the datacenter and how they compare to the catalog", run: cmdPlans},
+		{name: "stackscript", args: "sync|diff|udfs", summary: "Update the startup StackScript, show how it differs from the uploaded one or list its UDFs", run: cmdStackScript},
+		{name: "rdns", summary: "Report nodes whose reverse DNS differs from <node>.<domain>, or set it with -fix", run: cmdRDNS},
+		{name: "reveal", args: "<node>", summary: "Print the generated root password of a node", run: cmdReveal},
+		{name: "ssh-key", args: "show|rotate", summary: "Show the cluster's SSH key or replace it on every node", run: cmdSSHKey},
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] <command> [args]\n\nCommands:\n", os.Args[0])
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %s %s\t%s\n", c.name, c.args, c.summary)
+	}
+	w.Flush()
+	fmt.Fprintln(os.Stderr, "\nA <node> is either a Linode ID or a Linode label.\n\nFlags:")
+	flag.PrintDefaults()
+}
+
+func findCommand(name string) (*command, error) {
+	for _, c := range commands {
+		if c.name == name {
+			return c, nil
+		}
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	usage()
+	return nil, errUsage
+}
+
+// newFlagSet returns a FlagSet for a subcommand that prints its own usage line.
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [flags] %s\n", os.Args[0], name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses the flags of a subcommand and checks the number of positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string, n int) error {
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() != n {
+		fs.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+func cmdCreate(args []string) error {
+	fs := newFlagSet("create", "")
+	poolName := fs.String("pool", "", "Node pool of the new nodes (defaults to the first pool)")
+	count := fs.Int("count", 1, "Number of nodes to create")
+	if err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	pool, err := spec.NodePool(*poolName)
+	if err != nil {
+		return err
+	}
+
+	pools := make([]*NodePool, *count)
+	for i := range pools {
+		pools[i] = pool
+	}
+	if err := confirmCost(pools); err != nil {
+		return err
+	}
+
+	st, err := openState(true)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	p, err := newProvisioner(client, st)
+	if err != nil {
+		return err
+	}
+	results := p.createNodes(pools)
+	for _, r := range results {
+		if r.Err == nil {
+			fmt.Printf("Node %s created in pool %s\n", r.Node.Name, r.Pool)
+		}
+	}
+	return failedNodes(results)
+}
+
+func cmdReconcile(args []string) error {
+	fs := newFlagSet("reconcile", "")
+	prune := fs.Bool("prune", false, "Delete nodes of pools that are no longer in the spec")
+	if err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	st, err := openState(true)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	actions, err := reconcile(st, *prune)
+	if err == nil || len(actions) > 0 {
+		printActions(actions)
+	}
+	return err
+}
+
+func cmdDelete(args []string) error {
+	fs := newFlagSet("delete", "<node>")
+	if err := parseArgs(fs, args, 1); err != nil {
+		return err
+	}
+	st, err := openState(true)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	server, err := findNode(st, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	// skipChecks is required to delete a linode that still has disks attached.
+	_, err = client.Linode.Delete(server.LinodeId, true)
+	if err != nil {
+		return err
+	}
+	if err := st.Remove(server.LinodeId); err != nil {
+		return err
+	}
+	fmt.Printf("Linode %v (%s) deleted\n", server.LinodeId, server.Label.String())
+	return nil
+}
+
+func cmdList(args []string) error {
+	fs := newFlagSet("list", "")
+	local := fs.Bool("local", false, "List the nodes recorded in the local state instead of querying Linode")
+	if err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	if *local {
+		st, err := openState(false)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tLABEL\tPOOL\tPUBLIC IP\tPRIVATE IP\tCREATED")
+		for _, n := range st.Nodes() {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", n.LinodeID, n.Name, n.Pool, n.PublicIP, n.PrivateIP, n.CreatedAt.Format(time.RFC3339))
+		}
+		return w.Flush()
+	}
+
+	servers, err := listClusterNodes()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tLABEL\tPOOL\tSTATUS\tDATACENTER\tPLAN")
+	for _, s := range servers {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%d\n", s.LinodeId, s.Label.String(), poolOf(s), statusString(s.Status), s.DataCenterId, s.PlanId)
+	}
+	return w.Flush()
+}
+
+func cmdDescribe(args []string) error {
+	fs := newFlagSet("describe", "<node>")
+	if err := parseArgs(fs, args, 1); err != nil {
+		return err
+	}
+	st, err := openState(false)
+	if err != nil {
+		return err
+	}
+	server, err := findNode(st, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	ips, err := client.Ip.List(server.LinodeId, -1)
+	if err != nil {
+		return err
+	}
+	disks, err := client.Disk.List(server.LinodeId, 0)
+	if err != nil {
+		return err
+	}
+	configs, err := client.Config.List(server.LinodeId, 0)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%d\n", server.LinodeId)
+	fmt.Fprintf(w, "Label:\t%s\n", server.Label.String())
+	fmt.Fprintf(w, "Status:\t%s\n", statusString(server.Status))
+	fmt.Fprintf(w, "Datacenter:\t%d\n", server.DataCenterId)
+	fmt.Fprintf(w, "Plan:\t%d\n", server.PlanId)
+	fmt.Fprintf(w, "Display group:\t%s\n", server.LpmDisplayGroup)
+	for _, ip := range ips.FullIPAddresses {
+		kind := "Private IP:"
+		if ip.IsPublic == 1 {
+			kind = "Public IP:"
+		}
+		fmt.Fprintf(w, "%s\t%s\n", kind, ip.IPAddress)
+	}
+	for _, d := range disks.Disks {
+		fmt.Fprintf(w, "Disk %d:\t%s (%s, %d MB)\n", d.DiskId, d.Label.String(), d.Type, d.Size)
+	}
+	for _, c := range configs.LinodeConfigs {
+		fmt.Fprintf(w, "Config %d:\t%s (kernel %d, disks %s)\n", c.ConfigId, c.Label.String(), c.KernelId, c.DiskList)
+	}
+	if n := st.Find("", server.LinodeId); n != nil {
+		fmt.Fprintf(w, "Pool:\t%s\n", n.Pool)
+		fmt.Fprintf(w, "Created:\t%s\n", n.CreatedAt.Format(time.RFC3339))
+		fmt.Fprintf(w, "Jobs:\t%v\n", n.JobIDs)
+	} else {
+		fmt.Fprintf(w, "State:\tnot recorded in %s\n", clusterStateDir(spec.Name))
+	}
+	return w.Flush()
+}
+
+func cmdReboot(args []string) error {
+	fs := newFlagSet("reboot", "<node>")
+	if err := parseArgs(fs, args, 1); err != nil {
+		return err
+	}
+	st, err := openState(false)
+	if err != nil {
+		return err
+	}
+	server, err := findNode(st, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	jobResp, err := client.Linode.Reboot(server.LinodeId, 0)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Running linode reboot job %v for %s\n", jobResp.JobId.JobId, server.Label.String())
+	return nil
+}
+
+func cmdStackScript(args []string) error {
+	if len(args) == 0 || (args[0] != "sync" && args[0] != "diff" && args[0] != "udfs") {
+		fmt.Fprintf(os.Stderr, "Usage: %s stackscript sync|diff|udfs\n", os.Args[0])
+		return errUsage
+	}
+	fs := newFlagSet("stackscript "+args[0], "")
+	role := fs.String("role", "", "Use the StackScript of this node role instead of the cluster's; sync defaults to the scripts of all roles")
+	var remote *bool
+	if args[0] == "udfs" {
+		remote = fs.Bool("remote", false, "List the UDFs of the uploaded StackScript instead of the local template")
+	}
+	if err := parseArgs(fs, args[1:], 0); err != nil {
+		return err
+	}
+	if *role != "" && !containsString(nodeRoles, *role) {
+		return fmt.Errorf("unknown role %q, must be one of %s", *role, strings.Join(nodeRoles, ", "))
+	}
+	cfg := spec.NodeConfig(*role)
+	switch args[0] {
+	case "diff":
+		return diffStackScript(cfg)
+	case "udfs":
+		return listStackScriptUDFs(cfg, *remote)
+	}
+
+	configs := []NodeConfig{cfg}
+	if *role == "" {
+		configs = spec.nodeConfigs()
+	}
+	distro, err := resolveDistribution()
+	if err != nil {
+		return err
+	}
+	synced := map[string]bool{}
+	for _, cfg := range configs {
+		if synced[cfg.Script.Name] {
+			continue
+		}
+		synced[cfg.Script.Name] = true
+		script, err := renderStackScript(cfg)
+		if err != nil {
+			return err
+		}
+		scriptId, err := createOrUpdateStackScript(distro.DistributionId, script)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("StackScript %s synced with id %d\n", script.Label, scriptId)
+	}
+	return nil
+}
+
+// listClusterNodes returns the linodes that isClusterNode counts as part of this cluster.
+func listClusterNodes() ([]linodego.Linode, error) {
+	resp, err := client.Linode.List(0)
+	if err != nil {
+		return nil, err
+	}
+	servers := make([]linodego.Linode, 0, len(resp.Linodes))
+	for _, s := range resp.Linodes {
+		if isClusterNode(s) {
+			servers = append(servers, s)
+		}
+	}
+	return servers, nil
+}
+
+// findNode looks up a node of the cluster by its numeric ID or by its label. Nodes recorded in the
+// state are fetched directly instead of scanning all linodes of the account. Linodes that are
+// neither recorded in the state nor isClusterNode are refused, so that commands like delete can't
+// touch other linodes of the account.
+func findNode(st *stateStore, name string) (*linodego.Linode, error) {
+	server, err := lookupLinode(st, name)
+	if err != nil {
+		return nil, err
+	}
+	if st.Find("", server.LinodeId) == nil && !isClusterNode(*server) {
+		return nil, fmt.Errorf("linode %d (%s) is not a node of cluster %s", server.LinodeId, server.Label.String(), spec.Name)
+	}
+	return server, nil
+}
+
+func lookupLinode(st *stateStore, name string) (*linodego.Linode, error) {
+	if n := st.Find(name, 0); n != nil {
+		name = strconv.Itoa(n.LinodeID)
+	}
+	if id, err := strconv.Atoi(name); err == nil {
+		resp, err := client.Linode.List(id)
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Linodes) == 0 {
+			return nil, fmt.Errorf("linode %v: %v", id, ErrNotFound)
+		}
+		return &resp.Linodes[0], nil
+	}
+
+	resp, err := client.Linode.List(0)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range resp.Linodes {
+		if s.Label.String() == name {
+			return &s, nil
+		}
+	}
+	return nil, fmt.Errorf("linode %q: %v", name, ErrNotFound)
+}
+
+// diffStackScript prints the changes a sync would make to the uploaded StackScript of cfg.
+func diffStackScript(cfg NodeConfig) error {
+	script, err := renderStackScript(cfg)
+	if err != nil {
+		return err
+	}
+	remote, err := findStackScript(script.Label)
+	if err != nil {
+		return err
+	}
+	old := ""
+	if remote != nil {
+		old = normalizeScript(remote.Script)
+	}
+	d := unifiedDiff("remote/"+script.Label, "local/"+cfg.Script.Template, old, normalizeScript(script.Body))
+	if d == "" {
+		fmt.Printf("StackScript %s is up to date\n", script.Label)
+		return nil
+	}
+	fmt.Print(d)
+	return nil
+}
+
+// listStackScriptUDFs prints the UDFs declared by the rendered template of cfg, or by the uploaded
+// StackScript if remote is set.
+func listStackScriptUDFs(cfg NodeConfig, remote bool) error {
+	script, err := renderStackScript(cfg)
+	if err != nil {
+		return err
+	}
+	udfs := script.UDFs
+	if remote {
+		s, err := findStackScript(script.Label)
+		if err != nil {
+			return err
+		}
+		if s == nil {
+			return fmt.Errorf("StackScript %s: %v", script.Label, ErrNotFound)
+		}
+		udfs, err = parseUDFs(s.Script)
+		if err != nil {
+			return fmt.Errorf("StackScript %s: %v", script.Label, err)
+		}
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTYPE\tREQUIRED\tDEFAULT\tVALUES\tLABEL")
+	for _, u := range udfs {
+		values := strings.Join(append(u.OneOf, u.ManyOf...), ",")
+		fmt.Fprintf(w, "%s\t%s\t%v\t%s\t%s\t%s\n", u.Name, u.Type(), u.Required(), u.Default, values, u.Label)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	yes           = flag.Bool("yes", false, "Create nodes without asking for confirmation, whatever their estimated cost")
+	costThreshold = flag.Float64("cost-threshold", 100, "Ask for confirmation before creating nodes estimated to cost more than this many USD per month")
+)
+
+// estimatePaymentTerm is the payment term, in months, of the first invoice estimate.
+const estimatePaymentTerm = 1
+
+// PoolCost is the estimated cost of the nodes created in one pool. Prices are in USD.
+type PoolCost struct {
+	Pool         string
+	Nodes        int
+	Plan         string
+	Hourly       float64
+	Monthly      float64
+	FirstInvoice float64
+}
+
+// CostEstimate is the estimated cost of the nodes about to be created. InvoiceTo is the end of
+// the period covered by the prorated first invoice.
+type CostEstimate struct {
+	Pools        []PoolCost
+	Hourly       float64
+	Monthly      float64
+	FirstInvoice float64
+	InvoiceTo    time.Time
+}
+
+// estimateCost prices one new node for every entry of pools from the live plan prices, and the
+// prorated first invoice with EstimateInvoice.
+func estimateCost(pools []*NodePool) (*CostEstimate, error) {
+	est := &CostEstimate{}
+	index := map[string]int{}
+	invoices := map[int]float64{}
+	for _, pool := range pools {
+		plan, err := resolveRolePlan(pool.Role)
+		if err != nil {
+			return nil, err
+		}
+		planId := plan.PlanId
+		invoice, ok := invoices[planId]
+		if !ok {
+			r, err := client.Account.EstimateInvoice("linode_new", planId, estimatePaymentTerm, 0)
+			if err != nil {
+				return nil, fmt.Errorf("failed to estimate the invoice of plan %d: %v", planId, err)
+			}
+			invoice = float64(r.EstimateInvoice.Amount)
+			invoices[planId] = invoice
+			est.InvoiceTo = r.EstimateInvoice.InvoiceTo.Time
+		}
+
+		i, ok := index[pool.Name]
+		if !ok {
+			i = len(est.Pools)
+			index[pool.Name] = i
+			est.Pools = append(est.Pools, PoolCost{Pool: pool.Name, Plan: plan.Label()})
+		}
+		pc := &est.Pools[i]
+		pc.Nodes++
+		pc.Hourly += float64(plan.Hourly)
+		pc.Monthly += float64(plan.Price)
+		pc.FirstInvoice += invoice
+		est.Hourly += float64(plan.Hourly)
+		est.Monthly += float64(plan.Price)
+		est.FirstInvoice += invoice
+	}
+	return est, nil
+}
+
+func printCostEstimate(w io.Writer, est *CostEstimate) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "POOL\tNODES\tPLAN\tHOURLY\tMONTHLY\tFIRST INVOICE")
+	for _, pc := range est.Pools {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t$%.3f\t$%.2f\t$%.2f\n", pc.Pool, pc.Nodes, pc.Plan, pc.Hourly, pc.Monthly, pc.FirstInvoice)
+	}
+	nodes := 0
+	for _, pc := range est.Pools {
+		nodes += pc.Nodes
+	}
+	fmt.Fprintf(tw, "TOTAL\t%d\t\t$%.3f\t$%.2f\t$%.2f\n", nodes, est.Hourly, est.Monthly, est.FirstInvoice)
+	tw.Flush()
+	if !est.InvoiceTo.IsZero() {
+		fmt.Fprintf(w, "The first invoice is prorated up to %s.\n", est.InvoiceTo.Format("2006-01-02"))
+	}
+}
+
+// confirmCost prints the estimated cost of creating a node for every entry of pools. Above
+// -cost-threshold, the user has to confirm unless -yes is set. A dry run creates nothing, so it
+// never asks.
+func confirmCost(pools []*NodePool) error {
+	if len(pools) == 0 {
+		return nil
+	}
+	est, err := estimateCost(pools)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Estimated cost of the new nodes:")
+	printCostEstimate(os.Stdout, est)
+	if *dryRun || *yes || est.Monthly <= *costThreshold {
+		return nil
+	}
+
+	fmt.Printf("The estimate of $%.2f per month exceeds -cost-threshold of $%.2f. Continue? [y/N] ", est.Monthly, *costThreshold)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	if err == io.EOF {
+		fmt.Println()
+	}
+	return errors.New("aborted: the estimated cost was not confirmed, use -yes to skip the confirmation")
+}
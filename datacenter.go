@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/appscode/data"
+	"github.com/taoh/linodego"
+)
+
+// regionAliases maps the region names of the current Linode API to the abbreviations of the
+// datacenters of API v3.
+var regionAliases = map[string]string{
+	"us-central":   "dallas",
+	"us-west":      "fremont",
+	"us-southeast": "atlanta",
+	"us-east":      "newark",
+	"eu-west":      "london",
+	"ap-south":     "singapore",
+	"eu-central":   "frankfurt",
+	"ap-northeast": "shinagawa1",
+}
+
+// datacenterCache holds the datacenter of the spec once it is resolved.
+var datacenterCache struct {
+	mu sync.Mutex
+	dc *linodego.DataCenter
+}
+
+// validateDatacenterSelector checks the syntax of the datacenter of the spec: an ID, an
+// abbreviation like "newark", a region like "us-east" or a location like "Newark, NJ".
+func validateDatacenterSelector(s string) error {
+	if strings.TrimSpace(s) == "" {
+		return errors.New("is required")
+	}
+	if id, err := strconv.Atoi(s); err == nil && id <= 0 {
+		return fmt.Errorf("invalid datacenter ID %d", id)
+	}
+	return nil
+}
+
+// resolveDatacenter looks up the datacenter of the spec in Avail.DataCenters. Names are matched
+// against the abbreviation, the region aliases and the location, ignoring case; a location also
+// matches by its city alone. The result is cross-checked with the regions of the static catalog,
+// and differences are printed as warnings.
+func resolveDatacenter() (*linodego.DataCenter, error) {
+	datacenterCache.mu.Lock()
+	defer datacenterCache.mu.Unlock()
+	if datacenterCache.dc != nil {
+		return datacenterCache.dc, nil
+	}
+	resp, err := client.Avail.DataCenters()
+	if err != nil {
+		return nil, err
+	}
+	dc, err := matchDatacenter(spec.Datacenter, resp.DataCenters)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range compareRegion(dc, catalogRegions()) {
+		fmt.Printf("warning: datacenter %s: %s\n", dc.Abbr, w)
+	}
+	datacenterCache.dc = dc
+	return dc, nil
+}
+
+func matchDatacenter(selector string, dcs []linodego.DataCenter) (*linodego.DataCenter, error) {
+	name := strings.ToLower(strings.TrimSpace(selector))
+	if alias, ok := regionAliases[name]; ok {
+		name = alias
+	}
+	id, idErr := strconv.Atoi(name)
+	var matches []*linodego.DataCenter
+	for i, dc := range dcs {
+		location := strings.ToLower(dc.Location)
+		city := strings.TrimSpace(strings.SplitN(location, ",", 2)[0])
+		switch {
+		case idErr == nil && dc.DataCenterId == id,
+			strings.ToLower(dc.Abbr) == name,
+			location == name,
+			city == name:
+			matches = append(matches, &dcs[i])
+		}
+	}
+	switch len(matches) {
+	case 1:
+		return matches[0], nil
+	case 0:
+		msg := fmt.Sprintf("datacenter %q: %v", selector, ErrNotFound)
+		if s := suggestDatacenters(name, dcs); len(s) > 0 {
+			msg += "; did you mean " + strings.Join(s, " or ") + "?"
+		} else {
+			msg += "; known datacenters are " + datacenterNames(dcs)
+		}
+		return nil, errors.New(msg)
+	}
+	var names []string
+	for _, dc := range matches {
+		names = append(names, fmt.Sprintf("%s (%s)", dc.Abbr, dc.Location))
+	}
+	return nil, fmt.Errorf("datacenter %q is ambiguous, it matches %s", selector, strings.Join(names, ", "))
+}
+
+// suggestDatacenters returns the names close to name: those that contain it or are at most a third
+// of their length of edits away.
+func suggestDatacenters(name string, dcs []linodego.DataCenter) []string {
+	var candidates []string
+	for _, dc := range dcs {
+		candidates = append(candidates, strings.ToLower(dc.Abbr))
+	}
+	for alias := range regionAliases {
+		candidates = append(candidates, alias)
+	}
+	sort.Strings(candidates)
+	var suggestions []string
+	for _, c := range candidates {
+		if strings.Contains(c, name) || strings.Contains(name, c) || editDistance(name, c) <= (len(c)+2)/3 {
+			suggestions = append(suggestions, strconv.Quote(c))
+		}
+	}
+	return suggestions
+}
+
+// editDistance is the Levenshtein distance of a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, minInt(cur[j-1]+1, prev[j-1]+cost))
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func datacenterNames(dcs []linodego.DataCenter) string {
+	names := make([]string, 0, len(dcs))
+	for _, dc := range dcs {
+		names = append(names, fmt.Sprintf("%d (%s)", dc.DataCenterId, dc.Abbr))
+	}
+	return strings.Join(names, ", ")
+}
+
+// catalogRegions returns the Linode regions of the static catalog.
+func catalogRegions() []*data.Region {
+	if p := catalogProvider(); p != nil {
+		return p.Regions
+	}
+	return nil
+}
+
+// compareRegion lists the differences between a live datacenter and its region in the catalog,
+// where the region is the datacenter ID.
+func compareRegion(dc *linodego.DataCenter, regions []*data.Region) []string {
+	for _, r := range regions {
+		if r.Region != strconv.Itoa(dc.DataCenterId) {
+			continue
+		}
+		if !strings.EqualFold(r.Location, dc.Location) {
+			return []string{fmt.Sprintf("catalog has location %q, live datacenter has %q", r.Location, dc.Location)}
+		}
+		return nil
+	}
+	return []string{"not in the static catalog"}
+}
+
+// cmdDatacenters lists the live datacenters, the names they can be selected by and how they
+// compare to the static catalog.
+func cmdDatacenters(args []string) error {
+	fs := newFlagSet("datacenters", "")
+	if err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	resp, err := client.Avail.DataCenters()
+	if err != nil {
+		return err
+	}
+	regions := catalogRegions()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tABBR\tREGION\tLOCATION\tCATALOG")
+	for i := range resp.DataCenters {
+		dc := &resp.DataCenters[i]
+		region := ""
+		for alias, abbr := range regionAliases {
+			if abbr == dc.Abbr {
+				region = alias
+			}
+		}
+		status := "ok"
+		if diffs := compareRegion(dc, regions); len(diffs) > 0 {
+			status = strings.Join(diffs, "; ")
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", dc.DataCenterId, dc.Abbr, region, dc.Location, status)
+	}
+	for _, r := range regions {
+		found := false
+		for _, dc := range resp.DataCenters {
+			found = found || strconv.Itoa(dc.DataCenterId) == r.Region
+		}
+		if !found {
+			fmt.Fprintf(w, "%s\t\t\t%s\tonly in the static catalog\n", r.Region, r.Location)
+		}
+	}
+	return w.Flush()
+}
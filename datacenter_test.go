@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/taoh/linodego"
+)
+
+// apiV3DataCenters are the datacenters as avail.datacenters of API v3 lists them.
+var apiV3DataCenters = []linodego.DataCenter{
+	{DataCenterId: 2, Location: "Dallas, TX, USA", Abbr: "dallas"},
+	{DataCenterId: 3, Location: "Fremont, CA, USA", Abbr: "fremont"},
+	{DataCenterId: 4, Location: "Atlanta, GA, USA", Abbr: "atlanta"},
+	{DataCenterId: 6, Location: "Newark, NJ, USA", Abbr: "newark"},
+	{DataCenterId: 7, Location: "London, England, UK", Abbr: "london"},
+	{DataCenterId: 9, Location: "Singapore, SG", Abbr: "singapore"},
+	{DataCenterId: 10, Location: "Frankfurt, DE", Abbr: "frankfurt"},
+	{DataCenterId: 11, Location: "Tokyo 2, JP", Abbr: "shinagawa1"},
+}
+
+func TestRegionAliases(t *testing.T) {
+	want := map[string]int{
+		"us-central":   2,
+		"us-west":      3,
+		"us-southeast": 4,
+		"us-east":      6,
+		"eu-west":      7,
+		"ap-south":     9,
+		"eu-central":   10,
+		"ap-northeast": 11,
+	}
+	for alias := range regionAliases {
+		if _, ok := want[alias]; !ok {
+			t.Errorf("region alias %s has no test case", alias)
+		}
+	}
+	for alias, id := range want {
+		dc, err := matchDatacenter(alias, apiV3DataCenters)
+		if err != nil {
+			t.Errorf("matchDatacenter(%q): %v", alias, err)
+			continue
+		}
+		if dc.DataCenterId != id {
+			t.Errorf("matchDatacenter(%q) = %d (%s), want %d", alias, dc.DataCenterId, dc.Abbr, id)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name, a, b, want string
+	}{
+		{"equal", "x\ny\n", "x\ny\n", ""},
+		{"new file", "", "x\ny\n", "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+x\n+y\n"},
+		{"deleted file", "x\ny\n", "", "--- a\n+++ b\n@@ -1,2 +0,0 @@\n-x\n-y\n"},
+		{"changed line", "x\ny\nz\n", "x\nY\nz\n", "--- a\n+++ b\n@@ -1,3 +1,3 @@\n x\n-y\n+Y\n z\n"},
+	}
+	for _, test := range tests {
+		if got := unifiedDiff("a", "b", test.a, test.b); got != test.want {
+			t.Errorf("%s: unifiedDiff() =\n%s\nwant\n%s", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Disk types of data disks.
+const (
+	DiskTypeExt4 = "ext4"
+	DiskTypeRaw  = "raw"
+)
+
+// swapDiskLabel is the label of the swap disk of every node; the root disk is labelled after the node.
+const swapDiskLabel = "swap-disk"
+
+// maxDataDisks is what is left of the 8 devices of a config, sda to sdh, after root and swap.
+const maxDataDisks = 6
+
+// DiskSize is a disk size of the spec: a number of MB, or a percentage of the plan's disk for root
+// and data disks, such as "25%", and of the plan's RAM for swap, such as "200%".
+type DiskSize struct {
+	MB      int
+	Percent float64
+}
+
+func (d *DiskSize) UnmarshalJSON(b []byte) error {
+	var mb int
+	if err := json.Unmarshal(b, &mb); err == nil {
+		*d = DiskSize{MB: mb}
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("disk size must be a number of MB or a percentage, got %s", b)
+	}
+	size, err := parseDiskSize(s)
+	if err != nil {
+		return err
+	}
+	*d = size
+	return nil
+}
+
+func (d DiskSize) MarshalJSON() ([]byte, error) {
+	if d.Percent != 0 {
+		return json.Marshal(d.String())
+	}
+	return json.Marshal(d.MB)
+}
+
+func parseDiskSize(s string) (DiskSize, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, "%") {
+		p, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, "%")), 64)
+		if err != nil {
+			return DiskSize{}, fmt.Errorf("invalid disk size %q", s)
+		}
+		return DiskSize{Percent: p}, nil
+	}
+	mb, err := strconv.Atoi(s)
+	if err != nil {
+		return DiskSize{}, fmt.Errorf("invalid disk size %q, want a number of MB or a percentage", s)
+	}
+	return DiskSize{MB: mb}, nil
+}
+
+func (d DiskSize) IsZero() bool {
+	return d.MB == 0 && d.Percent == 0
+}
+
+func (d DiskSize) String() string {
+	if d.Percent != 0 {
+		return strconv.FormatFloat(d.Percent, 'g', -1, 64) + "%"
+	}
+	return fmt.Sprintf("%d MB", d.MB)
+}
+
+// Size returns the size in MB, taking a percentage of total MB.
+func (d DiskSize) Size(total int) int {
+	if d.Percent != 0 {
+		return int(float64(total) * d.Percent / 100)
+	}
+	return d.MB
+}
+
+// validate checks the size against maxPercent, which is 100 for a share of the disk; swap may be
+// a multiple of the RAM.
+func (d DiskSize) validate(errs *FieldErrors, field string, maxPercent float64) {
+	switch {
+	case d.MB < 0:
+		errs.Add(field, "must not be negative")
+	case d.Percent < 0 || d.Percent > maxPercent:
+		errs.Add(field, "percentage must be between 0 and %g, got %s", maxPercent, d)
+	}
+}
+
+// DiskLayout describes the disks of a node. A zero RootSize uses whatever the plan has left after
+// swap and the data disks.
+type DiskLayout struct {
+	RootSize DiskSize   `json:"rootSize,omitempty"`
+	SwapSize DiskSize   `json:"swapSize,omitempty"`
+	Data     []DataDisk `json:"data,omitempty"`
+}
+
+// DataDisk is an extra disk, e.g. for etcd or container storage. An ext4 disk is formatted by
+// Linode; a raw disk is left for the StackScript to set up.
+type DataDisk struct {
+	Label string   `json:"label"`
+	Size  DiskSize `json:"size"`
+	Type  string   `json:"type,omitempty"`
+}
+
+func (l *DiskLayout) setDefaults() {
+	if l.SwapSize.IsZero() {
+		l.SwapSize = DiskSize{MB: DefaultSwapDiskSize}
+	}
+	for i := range l.Data {
+		if l.Data[i].Type == "" {
+			l.Data[i].Type = DiskTypeExt4
+		}
+	}
+}
+
+func validateDiskLayout(errs *FieldErrors, field string, d *DiskLayout) {
+	d.RootSize.validate(errs, field+".rootSize", 100)
+	d.SwapSize.validate(errs, field+".swapSize", 400)
+	if len(d.Data) > maxDataDisks {
+		errs.Add(field+".data", "at most %d data disks fit in a config, got %d", maxDataDisks, len(d.Data))
+	}
+	labels := map[string]bool{}
+	for i, disk := range d.Data {
+		f := fmt.Sprintf("%s.data[%d]", field, i)
+		switch {
+		case disk.Label == "":
+			errs.Add(f+".label", "is required")
+		case disk.Label == swapDiskLabel:
+			errs.Add(f+".label", "%q is the label of the swap disk", swapDiskLabel)
+		case labels[disk.Label]:
+			errs.Add(f+".label", "duplicate disk label %q", disk.Label)
+		}
+		labels[disk.Label] = true
+		if disk.Size.IsZero() {
+			errs.Add(f+".size", "is required")
+		}
+		disk.Size.validate(errs, f+".size", 100)
+		if disk.Type != DiskTypeExt4 && disk.Type != DiskTypeRaw {
+			errs.Add(f+".type", "must be %s or %s, got %q", DiskTypeExt4, DiskTypeRaw, disk.Type)
+		}
+	}
+}
+
+// PlannedDisk is a disk to create, with its size in MB.
+type PlannedDisk struct {
+	Label string
+	Type  string
+	Size  int
+}
+
+// DiskPlan is a disk layout applied to a plan. Disks are attached in the order root, swap and the
+// data disks, as sda, sdb, sdc and so on.
+type DiskPlan struct {
+	Root int
+	Swap int
+	Data []PlannedDisk
+}
+
+// Total returns the space the disks take in MB.
+func (d *DiskPlan) Total() int {
+	total := d.Root + d.Swap
+	for _, disk := range d.Data {
+		total += disk.Size
+	}
+	return total
+}
+
+// planDisks sizes the disks of layout for plan and checks that they fit in the plan's disk.
+func planDisks(layout DiskLayout, plan *ResolvedPlan) (*DiskPlan, error) {
+	total := plan.DiskMB()
+	d := &DiskPlan{Swap: layout.SwapSize.Size(plan.RAM)}
+	data := 0
+	for _, disk := range layout.Data {
+		size := disk.Size.Size(total)
+		if size <= 0 {
+			return nil, fmt.Errorf("data disk %s of %s is %d MB with plan %s", disk.Label, disk.Size, size, plan.Label())
+		}
+		d.Data = append(d.Data, PlannedDisk{Label: disk.Label, Type: disk.Type, Size: size})
+		data += size
+	}
+	if d.Swap <= 0 {
+		return nil, fmt.Errorf("swap disk of %s is %d MB with plan %s", layout.SwapSize, d.Swap, plan.Label())
+	}
+
+	if layout.RootSize.IsZero() {
+		d.Root = total - d.Swap - data
+		if d.Root <= 0 {
+			return nil, fmt.Errorf("swap of %d MB and data disks of %d MB leave no room for the root disk on plan %s with %d MB",
+				d.Swap, data, plan.Label(), total)
+		}
+		return d, nil
+	}
+	d.Root = layout.RootSize.Size(total)
+	if d.Root <= 0 {
+		return nil, fmt.Errorf("root disk of %s is %d MB with plan %s", layout.RootSize, d.Root, plan.Label())
+	}
+	if d.Total() > total {
+		return nil, fmt.Errorf("the disks need %d MB (root %d MB, swap %d MB, data %d MB), but plan %s has %d MB",
+			d.Total(), d.Root, d.Swap, data, plan.Label(), total)
+	}
+	return d, nil
+}
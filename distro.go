@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/taoh/linodego"
+)
+
+// DistroSelector is a parsed "distro" field of the cluster spec. It is one of
+//
+//	146               a distribution ID
+//	ubuntu            the newest Ubuntu
+//	debian-9          the newest Debian 9.x
+//	ubuntu>=16.04     the newest Ubuntu of at least 16.04; also >, <=, < and =
+//	Ubuntu 16.04 LTS  an exact distribution label
+type DistroSelector struct {
+	ID      int
+	Label   string
+	Family  string
+	Op      string
+	Version []int
+}
+
+var (
+	distroPatternRegexp = regexp.MustCompile(`^([a-zA-Z]+)(?:(>=|<=|>|<|=|-)(\d+(?:\.\d+)*))?$`)
+	distroVersionRegexp = regexp.MustCompile(`\d+(?:\.\d+)*`)
+)
+
+func parseDistroSelector(s string) (DistroSelector, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return DistroSelector{}, errors.New("is required")
+	}
+	if id, err := strconv.Atoi(s); err == nil {
+		return DistroSelector{ID: id}, nil
+	}
+	m := distroPatternRegexp.FindStringSubmatch(s)
+	if m == nil {
+		if strings.ContainsAny(s, "<>=") {
+			return DistroSelector{}, fmt.Errorf("invalid distribution pattern %q, expected e.g. ubuntu>=16.04", s)
+		}
+		return DistroSelector{Label: s}, nil
+	}
+	sel := DistroSelector{Family: strings.ToLower(m[1]), Op: m[2]}
+	if sel.Op == "-" {
+		sel.Op = "="
+	}
+	if m[3] != "" {
+		sel.Version = parseVersion(m[3])
+	}
+	return sel, nil
+}
+
+func parseVersion(s string) []int {
+	parts := strings.Split(s, ".")
+	v := make([]int, len(parts))
+	for i, p := range parts {
+		v[i], _ = strconv.Atoi(p)
+	}
+	return v
+}
+
+// compareVersions compares a and b component by component, treating missing components as 0.
+func compareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// distroFamilyVersion splits a distribution label like "Ubuntu 16.04 LTS" into its family, the
+// lower cased first word, and its version.
+func distroFamilyVersion(label string) (string, []int) {
+	fields := strings.Fields(label)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	family := strings.ToLower(fields[0])
+	if v := distroVersionRegexp.FindString(label); v != "" {
+		return family, parseVersion(v)
+	}
+	return family, nil
+}
+
+// Matches reports whether the distribution with the given ID and label is selected.
+func (sel DistroSelector) Matches(id int, label string) bool {
+	switch {
+	case sel.ID != 0:
+		return id == sel.ID
+	case sel.Label != "":
+		return label == sel.Label
+	}
+	family, version := distroFamilyVersion(label)
+	if family != sel.Family {
+		return false
+	}
+	if sel.Op == "" {
+		return true
+	}
+	if version == nil {
+		return false
+	}
+	switch sel.Op {
+	case "=":
+		// debian-9 matches Debian 9 as well as Debian 9.3.
+		return len(version) >= len(sel.Version) && compareVersions(version[:len(sel.Version)], sel.Version) == 0
+	case ">=":
+		return compareVersions(version, sel.Version) >= 0
+	case ">":
+		return compareVersions(version, sel.Version) > 0
+	case "<=":
+		return compareVersions(version, sel.Version) <= 0
+	case "<":
+		return compareVersions(version, sel.Version) < 0
+	}
+	return false
+}
+
+// resolveDistribution picks the newest 64 bit distribution that matches the distro field of the
+// spec, and checks that its image fits on the planned root disk.
+func resolveDistribution() (*linodego.Distribution, error) {
+	sel, err := parseDistroSelector(spec.Distro)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Avail.Distributions()
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []*linodego.Distribution
+	skipped32 := 0
+	for i := range resp.Distributions {
+		d := &resp.Distributions[i]
+		if !sel.Matches(d.DistributionId, d.Label.String()) {
+			continue
+		}
+		if d.Is64Bit != 1 {
+			skipped32++
+			continue
+		}
+		matches = append(matches, d)
+	}
+	if len(matches) == 0 {
+		if skipped32 > 0 {
+			return nil, fmt.Errorf("distribution %q only matches 32 bit images", spec.Distro)
+		}
+		return nil, fmt.Errorf("distribution %q: %v", spec.Distro, ErrNotFound)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		_, vi := distroFamilyVersion(matches[i].Label.String())
+		_, vj := distroFamilyVersion(matches[j].Label.String())
+		if c := compareVersions(vi, vj); c != 0 {
+			return c > 0
+		}
+		return matches[i].DistributionId > matches[j].DistributionId
+	})
+	d := matches[0]
+
+	for i := range spec.NodePools {
+		pool := &spec.NodePools[i]
+		disks, err := spec.PoolConfig(pool).DiskPlan()
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %v", pool.Name, err)
+		}
+		if disks.Root < d.MinImageSize {
+			return nil, fmt.Errorf("distribution %s needs a root disk of at least %d MB, but the root disk of pool %s is %d MB",
+				d.Label.String(), d.MinImageSize, pool.Name, disks.Root)
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/taoh/linodego"
+)
+
+// importResult describes what import did with one linode, including anything that had to be guessed.
+type importResult struct {
+	LinodeID int
+	Label    string
+	Pool     string
+	Result   string
+	Notes    []string
+}
+
+func cmdImport(args []string) error {
+	fs := newFlagSet("import", "")
+	if err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	st, err := openState(true)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	results, err := importNodes(st)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tLABEL\tPOOL\tRESULT\tNOTES")
+	for _, r := range results {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", r.LinodeID, r.Label, r.Pool, r.Result, strings.Join(r.Notes, "; "))
+	}
+	w.Flush()
+	return err
+}
+
+// importNodes records every linode of the account that is a node of this cluster in the state:
+// linodes in one of the cluster's display groups, or named by its naming strategy. Where the linode
+// does not tell which pool, disk or config to use, the best guess is imported and a note explains
+// the ambiguity. A node already in the state only gets what the API reports updated.
+func importNodes(st *stateStore) ([]importResult, error) {
+	resp, err := client.Linode.List(0)
+	if err != nil {
+		return nil, err
+	}
+	var results []importResult
+	for _, s := range resp.Linodes {
+		label := s.Label.String()
+		if !isClusterNode(s) {
+			if s.LpmDisplayGroup != "" && namedByStrategy(label) {
+				results = append(results, importResult{
+					LinodeID: s.LinodeId,
+					Label:    label,
+					Result:   "skipped",
+					Notes:    []string{fmt.Sprintf("label matches but display group %q belongs elsewhere", s.LpmDisplayGroup)},
+				})
+			}
+			continue
+		}
+
+		r := importResult{LinodeID: s.LinodeId, Label: label}
+		node, notes, err := importNode(s)
+		r.Notes = append(r.Notes, notes...)
+		if err != nil {
+			r.Result = "error: " + err.Error()
+			results = append(results, r)
+			continue
+		}
+		if spec.Naming == NamingIP {
+			if want, err := (ipNaming{}).Candidate(NameRequest{Cluster: spec.Name, PublicIP: node.PublicIP}, 0); err == nil && want != label {
+				r.Notes = append(r.Notes, fmt.Sprintf("label does not match public IP %s", node.PublicIP))
+			}
+		}
+
+		r.Result = "imported"
+		if existing := st.Find("", s.LinodeId); existing != nil {
+			r.Result = "updated"
+			node = mergeImported(existing, node, poolOf(s) != "")
+		}
+		r.Pool = node.Pool
+		if err := st.Put(node); err != nil {
+			return results, err
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// mergeImported updates a copy of the recorded node with what importNode read from the API: name,
+// IPs, root and swap disk and config, and the pool if the display group tells it. The sealed root
+// password, job IDs and creation time are only known to the tool, and recorded data disks keep their
+// device order, so those are kept.
+func mergeImported(recorded, imported *NodeRecord, poolKnown bool) *NodeRecord {
+	node := *recorded
+	node.NodeInfo = imported.NodeInfo
+	node.ConfigID = imported.ConfigID
+	node.SwapDiskID = imported.SwapDiskID
+	if poolKnown || node.Pool == "" {
+		node.Pool = imported.Pool
+	}
+	if len(node.DataDiskIDs) == 0 {
+		node.DataDiskIDs = imported.DataDiskIDs
+	}
+	return &node
+}
+
+// importNode builds the state record of an existing linode from its IPs, disks and configs.
+func importNode(s linodego.Linode) (*NodeRecord, []string, error) {
+	var notes []string
+	node := &NodeRecord{
+		NodeInfo: NodeInfo{
+			Name:       s.Label.String(),
+			ExternalID: strconv.Itoa(s.LinodeId),
+		},
+		Pool:      poolOf(s),
+		LinodeID:  s.LinodeId,
+		CreatedAt: s.CreateDt.Time.UTC(),
+	}
+	if node.Pool == "" {
+		node.Pool = spec.NodePools[0].Name
+		notes = append(notes, "no display group, assumed default pool")
+	} else if _, err := spec.NodePool(node.Pool); err != nil {
+		notes = append(notes, fmt.Sprintf("pool %q is not in the spec", node.Pool))
+	}
+
+	ips, err := client.Ip.List(s.LinodeId, -1)
+	if err != nil {
+		return nil, notes, err
+	}
+	for _, ip := range ips.FullIPAddresses {
+		addr := &node.PrivateIP
+		kind := "private"
+		if ip.IsPublic == 1 {
+			addr = &node.PublicIP
+			kind = "public"
+		}
+		if *addr != "" {
+			notes = append(notes, fmt.Sprintf("several %s IPs, using %s", kind, *addr))
+			continue
+		}
+		*addr = ip.IPAddress
+	}
+
+	disks, err := client.Disk.List(s.LinodeId, 0)
+	if err != nil {
+		return nil, notes, err
+	}
+	var roots []linodego.Disk
+	for _, d := range disks.Disks {
+		switch d.Type {
+		case "swap":
+			if node.SwapDiskID != 0 {
+				notes = append(notes, "several swap disks")
+				continue
+			}
+			node.SwapDiskID = d.DiskId
+		case "ext3", "ext4":
+			roots = append(roots, d)
+		case "raw":
+			node.DataDiskIDs = append(node.DataDiskIDs, d.DiskId)
+		}
+	}
+	if root := pickRootDisk(roots, node.Name); root != nil {
+		node.DiskId = strconv.Itoa(root.DiskId)
+		if len(roots) > 1 {
+			notes = append(notes, fmt.Sprintf("several filesystem disks, using %d as root and the others as data disks", root.DiskId))
+		}
+		for _, d := range roots {
+			if d.DiskId != root.DiskId {
+				node.DataDiskIDs = append(node.DataDiskIDs, d.DiskId)
+			}
+		}
+	} else {
+		notes = append(notes, "no root disk found")
+	}
+
+	configs, err := client.Config.List(s.LinodeId, 0)
+	if err != nil {
+		return nil, notes, err
+	}
+	switch len(configs.LinodeConfigs) {
+	case 0:
+		notes = append(notes, "no config found")
+	case 1:
+		node.ConfigID = configs.LinodeConfigs[0].ConfigId
+	default:
+		node.ConfigID = configs.LinodeConfigs[0].ConfigId
+		notes = append(notes, fmt.Sprintf("several configs, using %d", node.ConfigID))
+	}
+	return node, notes, nil
+}
+
+// pickRootDisk prefers the disk labeled after the node, as createNode does, and falls back to the
+// largest one.
+func pickRootDisk(disks []linodego.Disk, name string) *linodego.Disk {
+	var root *linodego.Disk
+	for i := range disks {
+		d := &disks[i]
+		if d.Label.String() == name {
+			return d
+		}
+		if root == nil || d.Size > root.Size {
+			root = d
+		}
+	}
+	return root
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/taoh/linodego"
+)
+
+// Kernel policies accepted in the "kernel" field of the cluster spec.
+const (
+	KernelPolicyLatest     = "latest"
+	KernelPolicyPinned     = "pinned"
+	KernelPolicyGrub2      = "grub2"
+	KernelPolicyGrubLegacy = "grub-legacy"
+	KernelPolicyDirectDisk = "direct-disk"
+)
+
+// bootloaderKernels maps the policies that boot the distribution's own kernel to the label of the
+// pseudo kernel Linode uses for them.
+var bootloaderKernels = map[string]string{
+	KernelPolicyGrub2:      "GRUB 2",
+	KernelPolicyGrubLegacy: "GRUB (Legacy)",
+	KernelPolicyDirectDisk: "Direct Disk",
+}
+
+// KernelPolicy is a parsed kernel policy. Pin holds the kernel ID or label of a pinned policy.
+type KernelPolicy struct {
+	Kind string
+	Pin  string
+}
+
+func parseKernelPolicy(s string) (KernelPolicy, error) {
+	kind, pin := s, ""
+	if i := strings.Index(s, ":"); i >= 0 {
+		kind, pin = s[:i], s[i+1:]
+	}
+	switch kind {
+	case KernelPolicyPinned:
+		if pin == "" {
+			return KernelPolicy{}, errors.New("pinned kernel policy needs a kernel ID or label, e.g. pinned:138")
+		}
+		return KernelPolicy{Kind: kind, Pin: pin}, nil
+	case KernelPolicyLatest, KernelPolicyGrub2, KernelPolicyGrubLegacy, KernelPolicyDirectDisk:
+		if pin != "" {
+			return KernelPolicy{}, fmt.Errorf("kernel policy %s does not take an argument", kind)
+		}
+		return KernelPolicy{Kind: kind}, nil
+	}
+	return KernelPolicy{}, fmt.Errorf("unknown kernel policy %q, must be one of latest, pinned:<id|label>, grub2, grub-legacy or direct-disk", s)
+}
+
+// resolveKernel picks the kernel for the policy in spec among the kernels Linode offers, and checks
+// that it can boot distro on a KVM linode.
+func resolveKernel(distro *linodego.Distribution) (*linodego.Kernel, error) {
+	policy, err := parseKernelPolicy(spec.Kernel)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Avail.Kernels(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var k *linodego.Kernel
+	switch policy.Kind {
+	case KernelPolicyLatest:
+		k = latestKernel(resp.Kernels)
+		if k == nil {
+			return nil, errors.New("can't find a 64 bit KVM kernel")
+		}
+	case KernelPolicyPinned:
+		k = findKernel(resp.Kernels, policy.Pin)
+		if k == nil {
+			return nil, fmt.Errorf("kernel %q: %v", policy.Pin, ErrNotFound)
+		}
+	default:
+		k = findKernel(resp.Kernels, bootloaderKernels[policy.Kind])
+		if k == nil {
+			return nil, fmt.Errorf("no %q kernel is available for policy %s", bootloaderKernels[policy.Kind], policy.Kind)
+		}
+	}
+
+	if k.IsKvm != 1 {
+		return nil, fmt.Errorf("kernel %d (%s) is not KVM compatible", k.KernelId, k.Label.String())
+	}
+	// A bootloader boots the kernel installed by the distribution, so the distribution's need for a
+	// paravirt_ops kernel only applies to kernels supplied by Linode.
+	if distro.RequiresPVOPSKernel == 1 && k.IsPVOPS != 1 && !isBootloader(k) {
+		return nil, fmt.Errorf("distribution %s requires a PVOPS kernel, but kernel %d (%s) is not one",
+			distro.Label.String(), k.KernelId, k.Label.String())
+	}
+	return k, nil
+}
+
+// latestKernel prefers Linode's "Latest 64 bit" alias and falls back to the highest numbered
+// x86_64 PVOPS kernel.
+func latestKernel(kernels []linodego.Kernel) *linodego.Kernel {
+	var latest *linodego.Kernel
+	for i := range kernels {
+		k := &kernels[i]
+		if k.IsKvm != 1 || k.IsPVOPS != 1 {
+			continue
+		}
+		if strings.HasPrefix(k.Label.String(), "Latest 64 bit") {
+			return k
+		}
+		if strings.Contains(k.Label.String(), "x86_64") && (latest == nil || k.KernelId > latest.KernelId) {
+			latest = k
+		}
+	}
+	return latest
+}
+
+// findKernel looks a kernel up by ID or by label, ignoring case.
+func findKernel(kernels []linodego.Kernel, idOrLabel string) *linodego.Kernel {
+	id, err := strconv.Atoi(idOrLabel)
+	for i := range kernels {
+		k := &kernels[i]
+		if (err == nil && k.KernelId == id) || strings.EqualFold(k.Label.String(), idOrLabel) {
+			return k
+		}
+	}
+	return nil
+}
+
+func isBootloader(k *linodego.Kernel) bool {
+	for _, label := range bootloaderKernels {
+		if strings.EqualFold(k.Label.String(), label) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/appscode/data"
+	"github.com/appscode/data/files"
+)
+
+var allowDeprecated = flag.Bool("allow-deprecated", false, "Allow a Kubernetes version the catalog marks as deprecated")
+
+const (
+	// DefaultKubernetesEnv is the env of the catalog used if the spec names none. prod only lists
+	// versions older than kubeadm can bootstrap.
+	DefaultKubernetesEnv      = "qa"
+	DefaultKubernetesTemplate = "kubernetes.sh"
+
+	// The catalog of appscode/data lists the regions, instance types and Kubernetes versions of
+	// Linode under this name.
+	catalogProviderName = "linode"
+)
+
+// catalogProvider returns the Linode entry of the static catalog, or nil if it can't be read. data
+// only looks up single items, so the catalog is read directly; callers treat nil as an empty
+// catalog.
+func catalogProvider() *data.CloudProvider {
+	b, err := files.Asset("files/cloud_provider.json")
+	if err != nil {
+		return nil
+	}
+	var providers data.ClusterProviders
+	if err := json.Unmarshal(b, &providers); err != nil {
+		return nil
+	}
+	p, ok := providers.Provider[catalogProviderName]
+	if !ok {
+		return nil
+	}
+	return &p
+}
+
+// minKubeadmVersion is the first release whose kubeadm joins a master with
+// "kubeadm join --token <token> <ip>:6443", as the nodes do.
+var minKubeadmVersion = []int{1, 6, 0}
+
+// kubernetesAppURLs are the downloads of the catalog apps the template installs, by app; %s is the
+// version of the app. kubernetes-server provides kubeadm, kubelet and kubectl.
+var kubernetesAppURLs = map[string]string{
+	"kubernetes-server": "https://dl.k8s.io/v%s/kubernetes-server-linux-amd64.tar.gz",
+	"hostfacts":         "https://cdn.appscode.com/binaries/hostfacts/%s/hostfacts-linux-amd64",
+}
+
+// kubeadmReplacedApps run the salt based bootstrap of the catalog, which kubeadm replaces, so they
+// are not installed.
+var kubeadmReplacedApps = []string{"kubernetes-salt", "start-kubernetes"}
+
+// KubernetesSpec turns on the Kubernetes bootstrap: the StackScript installs Version, as listed for
+// Env in the appscode/data catalog, and the nodes of the worker pools join the master with kubeadm.
+type KubernetesSpec struct {
+	Version string `json:"version"`
+	Env     string `json:"env,omitempty"`
+}
+
+// resolveKubernetesVersion looks up the version of the spec in the catalog. Deprecated versions
+// are only accepted with -allow-deprecated; versions the template can't install never are.
+func resolveKubernetesVersion() (*data.CloudKubernetesVersion, error) {
+	k := spec.Kubernetes
+	v, err := data.LoadKubernetesVersion(catalogProviderName, k.Env, k.Version)
+	if err != nil {
+		if supported := supportedKubernetesVersions(k.Env); len(supported) > 0 {
+			return nil, fmt.Errorf("%v; supported versions are %s", err, strings.Join(supported, ", "))
+		}
+		return nil, err
+	}
+	if v.Deprecated && !*allowDeprecated {
+		msg := fmt.Sprintf("Kubernetes version %s is deprecated in env %s, use -allow-deprecated to install it anyway", v.Version, k.Env)
+		if supported := supportedKubernetesVersions(k.Env); len(supported) > 0 {
+			msg += "; supported versions are " + strings.Join(supported, ", ")
+		}
+		return nil, errors.New(msg)
+	}
+	if err := checkInstallable(v); err != nil {
+		if supported := supportedKubernetesVersions(k.Env); len(supported) > 0 {
+			return nil, fmt.Errorf("%v; supported versions are %s", err, strings.Join(supported, ", "))
+		}
+		return nil, fmt.Errorf("%v; env %s has no version that can be installed", err, k.Env)
+	}
+	return v, nil
+}
+
+// checkInstallable returns why the nodes can't install a catalog version, or nil: kubeadm is too
+// old, or one of the apps has no known download.
+func checkInstallable(v *data.CloudKubernetesVersion) error {
+	if compareVersions(parseVersion(v.Version), minKubeadmVersion) < 0 {
+		return fmt.Errorf("Kubernetes %s can't be bootstrapped with kubeadm, which needs version 1.6.0 or later", v.Version)
+	}
+	if _, ok := v.Apps["kubernetes-server"]; !ok {
+		return fmt.Errorf("the catalog lists no kubernetes-server app for Kubernetes %s", v.Version)
+	}
+	var unknown []string
+	for app := range v.Apps {
+		if _, ok := kubernetesAppURLs[app]; !ok && !containsString(kubeadmReplacedApps, app) {
+			unknown = append(unknown, app)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("the nodes can't install app %s of Kubernetes %s", strings.Join(unknown, ", "), v.Version)
+	}
+	return nil
+}
+
+// appDownloads returns the download URL of every app of v the template installs.
+func appDownloads(v *data.CloudKubernetesVersion) map[string]string {
+	urls := map[string]string{}
+	for app, version := range v.Apps {
+		if u, ok := kubernetesAppURLs[app]; ok {
+			urls[app] = fmt.Sprintf(u, version)
+		}
+	}
+	return urls
+}
+
+// supportedKubernetesVersions lists the versions of the catalog for env that are neither deprecated
+// nor impossible to install.
+func supportedKubernetesVersions(env string) []string {
+	p := catalogProvider()
+	if p == nil || p.Kubernetes == nil {
+		return nil
+	}
+	var versions []string
+	for _, v := range p.Kubernetes.VersionsByEnv[env] {
+		if !v.Deprecated && checkInstallable(v) == nil {
+			versions = append(versions, v.Version)
+		}
+	}
+	return versions
+}
+
+// masterPool returns the pool of the Kubernetes master, or nil if the Kubernetes bootstrap is off.
+func (s *ClusterSpec) masterPool() *NodePool {
+	if s.Kubernetes == nil {
+		return nil
+	}
+	for i := range s.NodePools {
+		if s.NodePools[i].Role == RoleMaster {
+			return &s.NodePools[i]
+		}
+	}
+	return nil
+}
+
+// kubernetesMaster returns the master recorded in the state, which workers join.
+func kubernetesMaster(st *stateStore) (*NodeRecord, error) {
+	pool := spec.masterPool()
+	for _, n := range st.Nodes() {
+		if n.Pool == pool.Name {
+			return n, nil
+		}
+	}
+	return nil, fmt.Errorf("no master of cluster %s is recorded in the state; create a node in pool %s first", spec.Name, pool.Name)
+}
+
+// joinInfo returns how a new node of pool joins the cluster. The master's address is left empty
+// for the master itself, which only gets it once its linode is created.
+func (p *provisioner) joinInfo(pool *NodePool) (*JoinInfo, error) {
+	join := &JoinInfo{Token: p.joinToken}
+	if pool.Role == RoleMaster {
+		return join, nil
+	}
+	master, err := kubernetesMaster(p.state)
+	if err != nil {
+		return nil, err
+	}
+	if master.PrivateIP == "" {
+		return nil, fmt.Errorf("master %s has no private IP recorded", master.Name)
+	}
+	join.MasterIP = master.PrivateIP
+	return join, nil
+}
+
+const tokenChars = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// generateJoinToken returns a bootstrap token in the [a-z0-9]{6}.[a-z0-9]{16} format of kubeadm.
+func generateJoinToken() (string, error) {
+	token := make([]byte, 23)
+	for i := range token {
+		if i == 6 {
+			token[i] = '.'
+			continue
+		}
+		c, err := randomChar(tokenChars)
+		if err != nil {
+			return "", err
+		}
+		token[i] = c
+	}
+	return string(token), nil
+}
+
+func joinTokenContext() string {
+	return spec.Name + "/joinToken"
+}
+
+// loadOrCreateJoinToken returns the kubeadm token of the cluster. It is generated with the first
+// node and kept in the state, sealed like the root passwords, so later workers can join. In a dry
+// run without a secrets key, a throwaway token is used.
+func loadOrCreateJoinToken(st *stateStore, box *secretBox) (string, error) {
+	if sealed := st.JoinToken(); sealed != nil {
+		if box == nil {
+			return "", fmt.Errorf("the kubeadm token of cluster %s is stored encrypted: set -secrets-key-file or %s", spec.Name, passphraseEnv)
+		}
+		return box.Open(sealed, joinTokenContext())
+	}
+	token, err := generateJoinToken()
+	if err != nil {
+		return "", err
+	}
+	if box == nil {
+		return token, nil
+	}
+	sealed, err := box.Seal(token, joinTokenContext())
+	if err != nil {
+		return "", err
+	}
+	return token, st.SetJoinToken(sealed)
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestDefaultKubernetesEnvInstallable(t *testing.T) {
+	versions := supportedKubernetesVersions(DefaultKubernetesEnv)
+	if len(versions) == 0 {
+		t.Fatalf("env %s has no Kubernetes version the template can install", DefaultKubernetesEnv)
+	}
+	defer func(s *ClusterSpec) { spec = s }(spec)
+	for _, version := range versions {
+		spec = &ClusterSpec{Kubernetes: &KubernetesSpec{Version: version, Env: DefaultKubernetesEnv}}
+		v, err := resolveKubernetesVersion()
+		if err != nil {
+			t.Errorf("version %s of env %s: %v", version, DefaultKubernetesEnv, err)
+			continue
+		}
+		if appDownloads(v)["kubernetes-server"] == "" {
+			t.Errorf("version %s of env %s has no kubernetes-server download", version, DefaultKubernetesEnv)
+		}
+	}
+}
+
+func TestCheckInstallableRejectsPreKubeadmVersions(t *testing.T) {
+	defer func(s *ClusterSpec) { spec = s }(spec)
+	spec = &ClusterSpec{Kubernetes: &KubernetesSpec{Version: "1.5.7", Env: "prod"}}
+	if _, err := resolveKubernetesVersion(); err == nil {
+		t.Error("Kubernetes 1.5.7 was accepted, but kubeadm can't bootstrap it")
+	}
+}
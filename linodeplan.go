@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/appscode/data"
+	"github.com/taoh/linodego"
+)
+
+// ResolvedPlan is the live plan a plan of the spec refers to, with the matching entry of the static
+// catalog, if any. Mismatches lists how the two disagree.
+type ResolvedPlan struct {
+	linodego.LinodePlan
+	Catalog    *data.InstanceType
+	Mismatches []string
+}
+
+// Label returns the label of the live plan.
+func (p *ResolvedPlan) Label() string {
+	return customString(&p.LinodePlan.Label)
+}
+
+// DiskMB returns the disk size of the plan in MB.
+func (p *ResolvedPlan) DiskMB() int {
+	return p.Disk * 1024
+}
+
+// planCache holds the live plan list and the plans resolved from it, so that each plan of the spec is
+// looked up and reported once per run.
+var planCache struct {
+	mu       sync.Mutex
+	live     []linodego.LinodePlan
+	resolved map[string]*ResolvedPlan
+}
+
+// validatePlanSelector checks the syntax of a plan of the spec: a plan ID or a plan label such as
+// "Linode 4096".
+func validatePlanSelector(s string) error {
+	if strings.TrimSpace(s) == "" {
+		return errors.New("is required")
+	}
+	if id, err := strconv.Atoi(s); err == nil && id <= 0 {
+		return fmt.Errorf("invalid plan ID %d", id)
+	}
+	return nil
+}
+
+// resolvePlan maps a plan of the spec to a live plan. An ID is looked up in the static catalog first;
+// if the live plan list has no plan with that ID, the plan with the catalog entry's CPU, RAM and disk
+// is used instead. A label is matched against the live plans, ignoring case. Differences between the
+// catalog and the live plan are printed as warnings the first time a plan is resolved.
+func resolvePlan(selector string) (*ResolvedPlan, error) {
+	planCache.mu.Lock()
+	defer planCache.mu.Unlock()
+	if p, ok := planCache.resolved[selector]; ok {
+		return p, nil
+	}
+	if planCache.live == nil {
+		resp, err := client.Avail.LinodePlans()
+		if err != nil {
+			return nil, err
+		}
+		planCache.live = resp.LinodePlans
+		planCache.resolved = map[string]*ResolvedPlan{}
+	}
+
+	catalog := catalogInstanceTypes()
+	var p *ResolvedPlan
+	if id, err := strconv.Atoi(selector); err == nil {
+		var it *data.InstanceType
+		for _, c := range catalog {
+			if c.ExternalSku == selector {
+				it = c
+			}
+		}
+		for i, lp := range planCache.live {
+			if lp.PlanId == id {
+				p = &ResolvedPlan{LinodePlan: planCache.live[i], Catalog: it}
+			}
+		}
+		if p == nil && it != nil {
+			for i, lp := range planCache.live {
+				if sameShape(it, &lp) {
+					p = &ResolvedPlan{LinodePlan: planCache.live[i], Catalog: it}
+					p.Mismatches = append(p.Mismatches, fmt.Sprintf("catalog plan %s (%s) is plan %d in the live plan list", selector, it.Description, lp.PlanId))
+					break
+				}
+			}
+		}
+		if p == nil {
+			return nil, fmt.Errorf("plan %d: %v; known plans are %s", id, ErrNotFound, planLabels(planCache.live))
+		}
+	} else {
+		for i, lp := range planCache.live {
+			if strings.EqualFold(customString(&lp.Label), strings.TrimSpace(selector)) {
+				p = &ResolvedPlan{LinodePlan: planCache.live[i]}
+			}
+		}
+		if p == nil {
+			return nil, fmt.Errorf("plan %q: %v; known plans are %s", selector, ErrNotFound, planLabels(planCache.live))
+		}
+		for _, c := range catalog {
+			if c.ExternalSku == strconv.Itoa(p.PlanId) || strings.EqualFold(c.Description, p.Label()) {
+				p.Catalog = c
+				break
+			}
+		}
+	}
+
+	p.Mismatches = append(p.Mismatches, comparePlan(p.Catalog, &p.LinodePlan)...)
+	for _, m := range p.Mismatches {
+		fmt.Printf("warning: plan %s: %s\n", p.Label(), m)
+	}
+	planCache.resolved[selector] = p
+	return p, nil
+}
+
+// resolveRolePlan resolves the plan of the nodes of role and checks that it is available in the
+// datacenter of the spec.
+func resolveRolePlan(role string) (*ResolvedPlan, error) {
+	p, err := resolvePlan(spec.NodeConfig(role).Plan)
+	if err != nil {
+		return nil, err
+	}
+	dc, err := resolveDatacenter()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.checkAvail(dc); err != nil {
+		return nil, fmt.Errorf("%v%s", err, roleSuffix(role))
+	}
+	return p, nil
+}
+
+// checkAvail fails if the plan is sold out in the datacenter, suggesting where it is available.
+func (p *ResolvedPlan) checkAvail(dc *linodego.DataCenter) error {
+	n, ok := p.Avail[strconv.Itoa(dc.DataCenterId)]
+	if ok && n > 0 {
+		return nil
+	}
+	var elsewhere []string
+	for dc, n := range p.Avail {
+		if n > 0 {
+			elsewhere = append(elsewhere, dc)
+		}
+	}
+	sort.Strings(elsewhere)
+	msg := fmt.Sprintf("plan %s is not available in datacenter %s", p.Label(), dc.Abbr)
+	if len(elsewhere) > 0 {
+		msg += "; it is available in datacenters " + strings.Join(elsewhere, ", ")
+	}
+	return errors.New(msg)
+}
+
+// catalogInstanceTypes returns the Linode instance types of the static catalog; without it, no
+// mismatches are reported.
+func catalogInstanceTypes() []*data.InstanceType {
+	if p := catalogProvider(); p != nil {
+		return p.InstanceTypes
+	}
+	return nil
+}
+
+// catalogRAM returns the RAM of a catalog instance type in GB.
+func catalogRAM(it *data.InstanceType) float64 {
+	switch ram := it.RAM.(type) {
+	case float64:
+		return ram
+	case int:
+		return float64(ram)
+	}
+	return 0
+}
+
+func sameShape(it *data.InstanceType, lp *linodego.LinodePlan) bool {
+	return it.CPU == lp.Cores && catalogRAM(it) == float64(lp.RAM)/1024 && it.Disk == lp.Disk
+}
+
+// comparePlan lists the differences between a catalog instance type and a live plan.
+func comparePlan(it *data.InstanceType, lp *linodego.LinodePlan) []string {
+	if it == nil {
+		return []string{"not in the static catalog"}
+	}
+	var diffs []string
+	if it.CPU != lp.Cores {
+		diffs = append(diffs, fmt.Sprintf("catalog has %d CPUs, live plan has %d", it.CPU, lp.Cores))
+	}
+	if ram := float64(lp.RAM) / 1024; math.Abs(catalogRAM(it)-ram) > 0.01 {
+		diffs = append(diffs, fmt.Sprintf("catalog has %g GB RAM, live plan has %g GB", catalogRAM(it), ram))
+	}
+	if it.Disk != lp.Disk {
+		diffs = append(diffs, fmt.Sprintf("catalog has a %d GB disk, live plan has %d GB", it.Disk, lp.Disk))
+	}
+	if !strings.EqualFold(it.Description, customString(&lp.Label)) {
+		diffs = append(diffs, fmt.Sprintf("catalog calls it %q", it.Description))
+	}
+	return diffs
+}
+
+func planLabels(plans []linodego.LinodePlan) string {
+	labels := make([]string, 0, len(plans))
+	for _, p := range plans {
+		labels = append(labels, fmt.Sprintf("%d (%s)", p.PlanId, customString(&p.Label)))
+	}
+	return strings.Join(labels, ", ")
+}
+
+// cmdPlans lists the live plans with their availability in the datacenter of the spec and how they
+// compare to the static catalog.
+func cmdPlans(args []string) error {
+	fs := newFlagSet("plans", "")
+	if err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	dc, err := resolveDatacenter()
+	if err != nil {
+		return err
+	}
+	resp, err := client.Avail.LinodePlans()
+	if err != nil {
+		return err
+	}
+	catalog := catalogInstanceTypes()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tLABEL\tCORES\tRAM\tDISK\tMONTHLY\tAVAIL IN %s\tCATALOG\n", strings.ToUpper(dc.Abbr))
+	for i := range resp.LinodePlans {
+		lp := &resp.LinodePlans[i]
+		var it *data.InstanceType
+		for _, c := range catalog {
+			if c.ExternalSku == strconv.Itoa(lp.PlanId) {
+				it = c
+			}
+		}
+		status := "ok"
+		if diffs := comparePlan(it, lp); len(diffs) > 0 {
+			status = strings.Join(diffs, "; ")
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d MB\t%d GB\t$%.2f\t%d\t%s\n", lp.PlanId, customString(&lp.Label), lp.Cores, lp.RAM, lp.Disk, lp.Price, lp.Avail[strconv.Itoa(dc.DataCenterId)], status)
+	}
+	for _, c := range catalog {
+		id, _ := strconv.Atoi(c.ExternalSku)
+		found := false
+		for _, lp := range resp.LinodePlans {
+			found = found || lp.PlanId == id
+		}
+		if !found {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%g GB\t%d GB\t\t\tonly in the static catalog\n", c.ExternalSku, c.Description, c.CPU, catalogRAM(c), c.Disk)
+		}
+	}
+	return w.Flush()
+}
@@ -2,15 +2,15 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/appscode/data"
 	"github.com/appscode/log"
-	"github.com/kr/pretty"
 	"github.com/tamalsaha/go-oneliners"
 	"github.com/taoh/linodego"
 	"k8s.io/apimachinery/pkg/util/wait"
@@ -26,15 +26,9 @@ var (
 
 	client *linodego.Client
 
-	kernel        = 0
-	instanceImage = 0
-
-	clusterName  = "c1"
-	zone         = "3"
-	sku          = "1"
-	rootPassword = "change@it" // CHANGE_IT
-
-	scriptName = "linode-demo"
+	specFile = flag.String("spec", "cluster.json", "Path to the cluster spec file, in JSON")
+	dryRun   = flag.Bool("dry-run", false, "Print the Linode API calls that would modify the account instead of making them")
+	spec     *ClusterSpec
 )
 
 type NodeInfo struct {
@@ -46,130 +40,86 @@ type NodeInfo struct {
 }
 
 func main() {
-	client = linodego.NewClient(os.Getenv("LINODE_TOKEN"), nil)
-
-	var err error
-	kernel, err = detectKernel()
-	if err != nil {
-		log.Fatalln(err)
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
 	}
-	oneliners.FILE("Kernel = ", kernel)
 
-	instanceImage, err = detectInstanceImage()
+	var err error
+	spec, err = LoadClusterSpec(*specFile)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	oneliners.FILE("InstanceImage = ", instanceImage)
 
-	scriptId, err := createOrUpdateStackScript()
+	c, err := findCommand(flag.Arg(0))
 	if err != nil {
-		log.Fatalln(err)
+		os.Exit(2)
 	}
-	oneliners.FILE("scriptId = ", scriptId)
-
-	err = createNode()
-	if err != nil {
-		log.Fatalln(err)
+	if c.dryRun {
+		*dryRun = true
 	}
-}
+	rec := newRecorder(nil, *dryRun)
+	client = linodego.NewClient(os.Getenv("LINODE_TOKEN"), &http.Client{Transport: rec})
 
-func detectKernel() (int, error) {
-	resp, err := client.Avail.Kernels(map[string]string{
-		"isKVM": "true",
-	})
-	if err != nil {
-		return 0, err
-	}
-	kernelId := -1
-	for _, d := range resp.Kernels {
-		if d.IsPVOPS == 1 {
-			if strings.HasPrefix(d.Label.String(), "Latest 64 bit") {
-				return d.KernelId, nil
-			}
-			if strings.Contains(d.Label.String(), "x86_64") && d.KernelId > kernelId {
-				kernelId = d.KernelId
-			}
-		}
+	err = c.run(flag.Args()[1:])
+	if err == errUsage {
+		os.Exit(2)
 	}
-	if kernelId >= 0 {
-		return kernelId, nil
+	if rec.dryRun {
+		printDryRun(os.Stdout, rec)
 	}
-	return 0, errors.New("can't find Kernel")
-}
-
-func detectInstanceImage() (int, error) {
-	resp, err := client.Avail.Distributions()
 	if err != nil {
-		return 0, err
-	}
-	for _, d := range resp.Distributions {
-		if d.Is64Bit == 1 && d.Label.String() == "Ubuntu 16.04 LTS" {
-			return d.DistributionId, nil
-		}
+		log.Fatalln(err)
 	}
-	return 0, errors.New("can't find `Ubuntu 16.04 LTS` image")
 }
 
-func waitForStatus(id, status int) error {
-	attempt := 0
+func (p *provisioner) waitForStatus(id, status int) error {
 	return wait.PollImmediate(RetryInterval, RetryTimeout, func() (bool, error) {
-		attempt++
-
-		resp, err := client.Linode.List(id)
+		resp, err := p.client.Linode.List(id)
 		if err != nil {
 			return false, nil
 		}
 		if len(resp.Linodes) == 0 {
 			return false, nil
 		}
-		server := resp.Linodes[0]
-		oneliners.FILE(fmt.Printf("Attempt %v: Instance `%v` is in status `%s`", attempt, id, statusString(server.Status)))
-		if server.Status == status {
-			return true, nil
-		}
-		return false, nil
+		return resp.Linodes[0].Status == status, nil
 	})
 }
 
-func getStartupScriptID() (int, error) {
-	scripts, err := client.StackScript.List(0)
+// createOrUpdateStackScript uploads script unless the StackScript with its label already has the
+// same content and can be deployed to the distribution.
+func createOrUpdateStackScript(distributionId int, script *StackScript) (int, error) {
+	s, err := findStackScript(script.Label)
 	if err != nil {
 		return 0, err
 	}
-	for _, s := range scripts.StackScripts {
-		if s.Label.String() == scriptName {
+	if s != nil {
+		args := map[string]string{}
+		if scriptHash(s.Script) != scriptHash(script.Body) {
+			args["script"] = script.Body
+		}
+		distributions := splitIDList(customString(&s.DistributionidList))
+		if !containsString(distributions, strconv.Itoa(distributionId)) {
+			args["DistributionIDList"] = strings.Join(append(distributions, strconv.Itoa(distributionId)), ",")
+		}
+		if len(args) == 0 {
+			oneliners.FILE("Stack script is up to date, revision", s.LatestRev)
 			return s.StackScriptId, nil
 		}
-	}
-	return 0, ErrNotFound
-}
-
-func createOrUpdateStackScript() (int, error) {
-	script := fmt.Sprintf(`#!/bin/bash
-# %s
-
-apt-get update
-apt-get upgrade -y
-`, time.Now().String())
-	scripts, err := client.StackScript.List(0)
-	if err != nil {
-		return 0, err
-	}
-	for _, s := range scripts.StackScripts {
-		if s.Label.String() == scriptName {
-			resp, err := client.StackScript.Update(s.StackScriptId, map[string]string{
-				"script": script,
-			})
-			if err != nil {
-				return 0, err
-			}
-			oneliners.FILE("Stack script for role updated")
-			return resp.StackScriptId.StackScriptId, nil
+		args["rev_note"] = revNote(s, script, distributionId)
+		resp, err := client.StackScript.Update(s.StackScriptId, args)
+		if err != nil {
+			return 0, err
 		}
+		oneliners.FILE("Stack script for role updated: ", args["rev_note"])
+		return resp.StackScriptId.StackScriptId, nil
 	}
 
-	resp, err := client.StackScript.Create(scriptName, strconv.Itoa(instanceImage), script, map[string]string{
-		"Description": fmt.Sprintf("Startup script for of Cluster %s", clusterName),
+	resp, err := client.StackScript.Create(script.Label, strconv.Itoa(distributionId), script.Body, map[string]string{
+		"Description": scriptDescription(script),
+		"rev_note":    "Initial version " + scriptHash(script.Body)[:12],
 	})
 	if err != nil {
 		return 0, err
@@ -178,6 +128,20 @@ apt-get upgrade -y
 	return resp.StackScriptId.StackScriptId, nil
 }
 
+func scriptDescription(script *StackScript) string {
+	if script.Role != "" {
+		return fmt.Sprintf("Startup script for role %s of cluster %s", script.Role, spec.Name)
+	}
+	return fmt.Sprintf("Startup script of cluster %s", spec.Name)
+}
+
+// customString is CustomString.String, except that it does not panic on fields missing from the
+// API response.
+func customString(cs *linodego.CustomString) string {
+	b, _ := cs.MarshalJSON()
+	return strings.Trim(string(b), `"`)
+}
+
 const (
 	LinodeStatus_BeingCreated = -1
 	LinodeStatus_BrandNew     = 0
@@ -203,113 +167,202 @@ func statusString(status int) string {
 	}
 }
 
-func createNode() error {
-	dcId, err := strconv.Atoi(zone)
+// pickName reserves a name for a new node of pool and registers its release in rb.
+func (p *provisioner) pickName(pool *NodePool, publicIP string, rb *rollback) (string, error) {
+	name, err := pickName(p.naming, p.labels, NameRequest{
+		Cluster:  spec.Name,
+		Pool:     pool.Name,
+		PublicIP: publicIP,
+	})
 	if err != nil {
-		return err
+		return "", err
 	}
-	planId, err := strconv.Atoi(sku)
+	rb.Add(fmt.Sprintf("release name %s", name), func() error {
+		p.labels.Release(name)
+		return nil
+	})
+	return name, nil
+}
+
+// provisionNode runs the steps of createNode, registering a compensating action in rb for every
+// resource it creates.
+func (p *provisioner) provisionNode(task string, pool *NodePool, rb *rollback) (*NodeRecord, error) {
+	dc, err := resolveDatacenter()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	role := p.roles[pool.Role]
+	planId := role.plan.PlanId
+	var join *JoinInfo
+	if spec.Kubernetes != nil {
+		join, err = p.joinInfo(pool)
+		if err != nil {
+			return nil, err
+		}
 	}
-	server, err := client.Linode.Create(dcId, planId, 0)
+	// Names that don't depend on the public IP are picked before anything is created, so that an
+	// invalid or exhausted name costs no linode.
+	name := ""
+	if !p.naming.NeedsPublicIP() {
+		if name, err = p.pickName(pool, "", rb); err != nil {
+			return nil, err
+		}
+	}
+	p.progress.Step(task, "creating linode")
+	server, err := p.client.Linode.Create(dc.DataCenterId, planId, 0)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	linodeId := server.LinodeId.LinodeId
+	rb.Add(fmt.Sprintf("delete linode %d", linodeId), func() error {
+		_, err := p.client.Linode.Delete(linodeId, true)
+		return err
+	})
 
-	_, err = client.Ip.AddPrivate(linodeId)
+	private, err := p.client.Ip.AddPrivate(linodeId)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = waitForStatus(linodeId, LinodeStatus_BrandNew)
+	p.progress.Step(task, fmt.Sprintf("waiting for linode %d", linodeId))
+	err = p.waitForStatus(linodeId, LinodeStatus_BrandNew)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	node := NodeInfo{
-		ExternalID: strconv.Itoa(linodeId),
+	node := &NodeRecord{
+		NodeInfo: NodeInfo{
+			ExternalID: strconv.Itoa(linodeId),
+		},
+		Pool:      pool.Name,
+		LinodeID:  linodeId,
+		CreatedAt: time.Now().UTC(),
 	}
-	ips, err := client.Ip.List(linodeId, -1)
+	ips, err := p.client.Ip.List(linodeId, -1)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if err := verifyPrivateIP(linodeId, private.IPAddress.IPAddress, ips.FullIPAddresses); err != nil {
+		return nil, err
 	}
+	node.PrivateIP = private.IPAddress.IPAddress
+	publicIPId := 0
 	for _, ip := range ips.FullIPAddresses {
 		if ip.IsPublic == 1 {
 			node.PublicIP = ip.IPAddress
-		} else {
-			node.PrivateIP = ip.IPAddress
+			publicIPId = ip.IPAddressId
 		}
 	}
-	oneliners.FILE(fmt.Sprintf("Node = %v", pretty.Formatter(node)))
 
-	parts := strings.SplitN(node.PublicIP, ".", 4)
-	node.Name = fmt.Sprintf("%s-%03s-%03s-%03s-%03s", clusterName, parts[0], parts[1], parts[2], parts[3])
-	fmt.Printf("%03s-%03d-%03d-%03d", "1", 2, 3, 4)
-
-	//node.Name = "c1-xyz"
+	if name == "" {
+		if name, err = p.pickName(pool, node.PublicIP, rb); err != nil {
+			return nil, err
+		}
+	}
+	node.Name = name
 
-	_, err = client.Linode.Update(linodeId, map[string]interface{}{
-		"Label": node.Name,
+	_, err = p.client.Linode.Update(linodeId, map[string]interface{}{
+		"Label":            node.Name,
+		"lpm_displayGroup": displayGroup(pool.Name),
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	scriptId, err := getStartupScriptID()
-	if err != nil {
-		return err
+	// Forward DNS may not be in place yet, so a node without reverse DNS is kept; rdns -fix sets it later.
+	if spec.Domain != "" {
+		p.progress.Step(task, "setting reverse DNS")
+		if err := setRDNS(p.client, linodeId, publicIPId, nodeFQDN(node.Name)); err != nil {
+			fmt.Printf("warning: node %s: %v\n", node.Name, err)
+		}
 	}
 
-	stackScriptUDFResponses := fmt.Sprintf(`{"hostname": "%s"}`, node.Name)
-
-	mt, err := data.ClusterMachineType("linode", sku)
+	if join != nil && join.MasterIP == "" {
+		join.MasterIP = node.PrivateIP
+	}
+	udfResponses := role.script.UDFResponses(node, pool, join)
+	if err := validateUDFResponses(role.script.UDFs, udfResponses); err != nil {
+		return nil, err
+	}
+	stackScriptUDFResponses, err := udfResponses.JSON()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	distributionID := instanceImage
-	//, err := strconv.Atoi(instanceImage)
-	//if err != nil {
-	//	return err
-	//}
-	swapDiskSize := 512                // MB
-	rootDiskSize := mt.Disk*1024 - 512 // MB
+
+	distributionID := p.instanceImage
+	disks := p.disks[pool.Name]
 	args := map[string]string{
-	// "rootSSHKey": string(SSHKey(ctx).PublicKey),
+		"rootSSHKey": p.sshKey.AuthorizedKey(),
 	}
-	rootDisk, err := client.Disk.CreateFromStackscript(scriptId, linodeId, node.Name, stackScriptUDFResponses, distributionID, rootDiskSize, rootPassword, args)
+	rootPassword, err := generatePassword()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	swapDisk, err := client.Disk.Create(linodeId, "swap", "swap-disk", swapDiskSize, nil)
+	if p.secrets != nil {
+		node.RootPassword, err = p.secrets.Seal(rootPassword, rootPasswordContext(linodeId))
+		if err != nil {
+			return nil, err
+		}
+	}
+	p.progress.Step(task, fmt.Sprintf("creating disks for %s", node.Name))
+	rootDisk, err := p.client.Disk.CreateFromStackscript(role.scriptId, linodeId, node.Name, stackScriptUDFResponses, distributionID, disks.Root, rootPassword, args)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	kernelId := kernel
-	// TODO: Boot to grub2 : kernel id 201
-	//kernelId, err := strconv.Atoi(kernel)
-	//if err != nil {
-	//	return err
-	//}
-	config, err := client.Config.Create(linodeId, kernelId, node.Name, map[string]string{
-		"RootDeviceNum": "1",
-		"DiskList":      fmt.Sprintf("%d,%d", rootDisk.DiskJob.DiskId, swapDisk.DiskJob.DiskId),
+	node.DiskId = strconv.Itoa(rootDisk.DiskJob.DiskId)
+	node.JobIDs = append(node.JobIDs, rootDisk.DiskJob.JobId)
+	rb.Add(fmt.Sprintf("delete root disk %d", rootDisk.DiskJob.DiskId), func() error {
+		_, err := p.client.Disk.Delete(linodeId, rootDisk.DiskJob.DiskId)
+		return err
 	})
+	swapDisk, err := p.client.Disk.Create(linodeId, "swap", swapDiskLabel, disks.Swap, nil)
 	if err != nil {
+		return nil, err
+	}
+	node.SwapDiskID = swapDisk.DiskJob.DiskId
+	node.JobIDs = append(node.JobIDs, swapDisk.DiskJob.JobId)
+	rb.Add(fmt.Sprintf("delete swap disk %d", swapDisk.DiskJob.DiskId), func() error {
+		_, err := p.client.Disk.Delete(linodeId, swapDisk.DiskJob.DiskId)
 		return err
+	})
+	// The position in DiskList is the device: root is sda, swap sdb and the data disks follow.
+	diskList := []string{strconv.Itoa(rootDisk.DiskJob.DiskId), strconv.Itoa(swapDisk.DiskJob.DiskId)}
+	for _, d := range disks.Data {
+		dataDisk, err := p.client.Disk.Create(linodeId, d.Type, d.Label, d.Size, nil)
+		if err != nil {
+			return nil, err
+		}
+		diskId := dataDisk.DiskJob.DiskId
+		node.DataDiskIDs = append(node.DataDiskIDs, diskId)
+		node.JobIDs = append(node.JobIDs, dataDisk.DiskJob.JobId)
+		rb.Add(fmt.Sprintf("delete data disk %d", diskId), func() error {
+			_, err := p.client.Disk.Delete(linodeId, diskId)
+			return err
+		})
+		diskList = append(diskList, strconv.Itoa(diskId))
 	}
-	jobResp, err := client.Linode.Boot(linodeId, config.LinodeConfigId.LinodeConfigId)
+
+	config, err := p.client.Config.Create(linodeId, p.kernel, node.Name, map[string]string{
+		"RootDeviceNum":  "1",
+		"DiskList":       strings.Join(diskList, ","),
+		"helper_network": "true",
+	})
 	if err != nil {
+		return nil, err
+	}
+	node.ConfigID = config.LinodeConfigId.LinodeConfigId
+	rb.Add(fmt.Sprintf("delete config %d", config.LinodeConfigId.LinodeConfigId), func() error {
+		_, err := p.client.Config.Delete(linodeId, config.LinodeConfigId.LinodeConfigId)
 		return err
+	})
+	p.progress.Step(task, "booting")
+	jobResp, err := p.client.Linode.Boot(linodeId, config.LinodeConfigId.LinodeConfigId)
+	if err != nil {
+		return nil, err
 	}
-	oneliners.FILE(fmt.Printf("Running linode boot job %v", jobResp.JobId.JobId))
-	oneliners.FILE(fmt.Printf("Linode %v created", node.Name))
+	node.JobIDs = append(node.JobIDs, jobResp.JobId.JobId)
 
-	//err = waitForStatus(linodeId, LinodeStatus_Running)
-	//if err != nil {
-	//	return err
-	//}
-
-	return nil
+	if err := p.waitReady(task, node, jobResp.JobId.JobId); err != nil {
+		return node, err
+	}
+	return node, nil
 }
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	NamingIP     = "ip"
+	NamingIndex  = "index"
+	NamingRandom = "random"
+	NamingPool   = "pool"
+
+	// maxNameAttempts bounds the number of candidates tried before giving up on finding a free label.
+	maxNameAttempts = 100
+)
+
+var errNoMoreNames = errors.New("no more candidate names")
+
+// NameRequest carries what a NamingStrategy may use to name a new node.
+type NameRequest struct {
+	Cluster  string
+	Pool     string
+	PublicIP string
+}
+
+// NamingStrategy derives Linode labels for new nodes. Candidate is called with increasing attempt
+// numbers, starting at 0, until it returns a label that is not used yet, or errNoMoreNames.
+// Pattern is a regular expression matching every label Candidate can return for a pool.
+// NeedsPublicIP reports whether Candidate uses req.PublicIP, so that the node can only be named
+// once its linode exists.
+type NamingStrategy interface {
+	Candidate(req NameRequest, attempt int) (string, error)
+	Pattern(cluster, pool string) string
+	NeedsPublicIP() bool
+}
+
+func namingStrategy(name string) (NamingStrategy, error) {
+	switch name {
+	case NamingIP:
+		return ipNaming{}, nil
+	case NamingIndex:
+		return indexNaming{}, nil
+	case NamingRandom:
+		return randomNaming{}, nil
+	case NamingPool:
+		return poolNaming{}, nil
+	}
+	return nil, fmt.Errorf("unknown naming strategy %q", name)
+}
+
+// ipNaming names a node after its public IPv4 address, e.g. c1-045-079-012-003.
+type ipNaming struct{}
+
+func (ipNaming) Candidate(req NameRequest, attempt int) (string, error) {
+	if attempt > 0 {
+		return "", errNoMoreNames
+	}
+	ip := net.ParseIP(req.PublicIP).To4()
+	if ip == nil {
+		return "", fmt.Errorf("can't derive a node name from %q, it is not an IPv4 address", req.PublicIP)
+	}
+	return fmt.Sprintf("%s-%03d-%03d-%03d-%03d", req.Cluster, ip[0], ip[1], ip[2], ip[3]), nil
+}
+
+func (ipNaming) Pattern(cluster, pool string) string {
+	return regexp.QuoteMeta(cluster) + `-\d{3}-\d{3}-\d{3}-\d{3}`
+}
+
+func (ipNaming) NeedsPublicIP() bool { return true }
+
+// indexNaming numbers nodes sequentially, e.g. c1-001, using the lowest free index.
+type indexNaming struct{}
+
+func (indexNaming) Candidate(req NameRequest, attempt int) (string, error) {
+	return fmt.Sprintf("%s-%03d", req.Cluster, attempt+1), nil
+}
+
+func (indexNaming) Pattern(cluster, pool string) string {
+	return regexp.QuoteMeta(cluster) + `-\d{3,}`
+}
+
+func (indexNaming) NeedsPublicIP() bool { return false }
+
+// poolNaming numbers nodes sequentially within their pool, e.g. c1-workers-001.
+type poolNaming struct{}
+
+func (poolNaming) Candidate(req NameRequest, attempt int) (string, error) {
+	return fmt.Sprintf("%s-%s-%03d", req.Cluster, req.Pool, attempt+1), nil
+}
+
+func (poolNaming) Pattern(cluster, pool string) string {
+	return regexp.QuoteMeta(cluster) + "-" + regexp.QuoteMeta(pool) + `-\d{3,}`
+}
+
+func (poolNaming) NeedsPublicIP() bool { return false }
+
+// randomNaming appends a random suffix of alternating letters and digits, e.g. c1-x7k2q4. The
+// alternation tells generated names from hand-made ones like c1-backup.
+type randomNaming struct{}
+
+const (
+	randomNameLetters = "abcdefghijklmnopqrstuvwxyz"
+	randomNameDigits  = "0123456789"
+)
+
+func (randomNaming) Candidate(req NameRequest, attempt int) (string, error) {
+	suffix := make([]byte, 6)
+	for i := range suffix {
+		chars := randomNameLetters
+		if i%2 == 1 {
+			chars = randomNameDigits
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+		if err != nil {
+			return "", err
+		}
+		suffix[i] = chars[n.Int64()]
+	}
+	return req.Cluster + "-" + string(suffix), nil
+}
+
+func (randomNaming) Pattern(cluster, pool string) string {
+	return regexp.QuoteMeta(cluster) + "-([a-z][0-9]){3}"
+}
+
+func (randomNaming) NeedsPublicIP() bool { return false }
+
+// longestCandidate returns the longest label strategy can give a node of pool, so that the spec
+// can be checked against the label rules before any linode is created.
+func longestCandidate(strategy NamingStrategy, cluster, pool string) (string, error) {
+	req := NameRequest{Cluster: cluster, Pool: pool, PublicIP: "255.255.255.255"}
+	name, err := strategy.Candidate(req, maxNameAttempts-1)
+	if err == errNoMoreNames {
+		name, err = strategy.Candidate(req, 0)
+	}
+	return name, err
+}
+
+// namePatterns caches the compiled patterns of namedByStrategy, which runs for every linode of the
+// account.
+var namePatterns struct {
+	mu sync.Mutex
+	re map[string]*regexp.Regexp
+}
+
+func namePattern(pattern string) *regexp.Regexp {
+	namePatterns.mu.Lock()
+	defer namePatterns.mu.Unlock()
+	if re, ok := namePatterns.re[pattern]; ok {
+		return re
+	}
+	if namePatterns.re == nil {
+		namePatterns.re = map[string]*regexp.Regexp{}
+	}
+	re := regexp.MustCompile("^" + pattern + "$")
+	namePatterns.re[pattern] = re
+	return re
+}
+
+// namedByStrategy reports whether label is one the naming strategy of the spec gives to the nodes
+// of one of its pools.
+func namedByStrategy(label string) bool {
+	strategy, err := namingStrategy(spec.Naming)
+	if err != nil {
+		return false
+	}
+	for _, p := range spec.NodePools {
+		if namePattern(strategy.Pattern(spec.Name, p.Name)).MatchString(label) {
+			return true
+		}
+	}
+	return false
+}
+
+var linodeLabelRegexp = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]{1,30}[a-zA-Z0-9]$`)
+
+// validateLabel checks a name against Linode's label rules: 3 to 32 characters, starting with a
+// letter, ending with a letter or digit, using only letters, digits, '-' and '_', and without
+// consecutive '-' or '_'.
+func validateLabel(label string) error {
+	if !linodeLabelRegexp.MatchString(label) {
+		return fmt.Errorf("invalid label %q: must be 3-32 characters of letters, digits, '-' and '_', start with a letter and end with a letter or digit", label)
+	}
+	if strings.Contains(label, "--") || strings.Contains(label, "__") {
+		return fmt.Errorf("invalid label %q: must not contain consecutive '-' or '_'", label)
+	}
+	return nil
+}
+
+// labelRegistry tracks the labels in use across the account so that concurrently created nodes
+// never pick the same label.
+type labelRegistry struct {
+	mu    sync.Mutex
+	taken map[string]bool
+}
+
+func newLabelRegistry(labels []string) *labelRegistry {
+	r := &labelRegistry{taken: make(map[string]bool, len(labels))}
+	for _, l := range labels {
+		r.taken[l] = true
+	}
+	return r
+}
+
+// Reserve marks label as used. It returns false if the label was already taken.
+func (r *labelRegistry) Reserve(label string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.taken[label] {
+		return false
+	}
+	r.taken[label] = true
+	return true
+}
+
+// Release makes a reserved label available again, e.g. after the node was rolled back.
+func (r *labelRegistry) Release(label string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.taken, label)
+}
+
+// pickName asks the strategy for candidates until one is a valid label that no other linode uses,
+// and reserves it.
+func pickName(strategy NamingStrategy, labels *labelRegistry, req NameRequest) (string, error) {
+	last := ""
+	for attempt := 0; attempt < maxNameAttempts; attempt++ {
+		name, err := strategy.Candidate(req, attempt)
+		if err == errNoMoreNames {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if err := validateLabel(name); err != nil {
+			return "", err
+		}
+		if labels.Reserve(name) {
+			return name, nil
+		}
+		last = name
+	}
+	return "", fmt.Errorf("can't find a free name for a node in pool %s, label %s is already in use", req.Pool, last)
+}
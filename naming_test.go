@@ -0,0 +1,53 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestCandidatesMatchPattern(t *testing.T) {
+	req := NameRequest{Cluster: "c1", Pool: "workers", PublicIP: "45.79.12.3"}
+	for _, name := range []string{NamingIP, NamingIndex, NamingPool, NamingRandom} {
+		strategy, err := namingStrategy(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		re := regexp.MustCompile("^" + strategy.Pattern(req.Cluster, req.Pool) + "$")
+		for attempt := 0; attempt < 20; attempt++ {
+			label, err := strategy.Candidate(req, attempt)
+			if err == errNoMoreNames {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if !re.MatchString(label) {
+				t.Errorf("%s: candidate %s does not match pattern %s", name, label, re)
+			}
+		}
+	}
+}
+
+func TestNamedByStrategyIgnoresHandMadeLabels(t *testing.T) {
+	defer func(s *ClusterSpec) { spec = s }(spec)
+	tests := []struct {
+		naming, label string
+		want          bool
+	}{
+		{NamingIP, "c1-045-079-012-003", true},
+		{NamingIP, "c1-prod-045-079-012-003", false},
+		{NamingIndex, "c1-007", true},
+		{NamingIndex, "c1-backup", false},
+		{NamingPool, "c1-workers-001", true},
+		{NamingPool, "c1-other-001", false},
+		{NamingRandom, "c1-x7k2q4", true},
+		{NamingRandom, "c1-backup", false},
+		{NamingRandom, "c1-backup-x7k2q4", false},
+	}
+	for _, test := range tests {
+		spec = &ClusterSpec{Name: "c1", Naming: test.naming, NodePools: []NodePool{{Name: "workers"}}}
+		if got := namedByStrategy(test.label); got != test.want {
+			t.Errorf("naming %s: namedByStrategy(%s) = %v, want %v", test.naming, test.label, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/taoh/linodego"
+)
+
+// privateNetwork is the range Linode assigns private IPs from. Private IPs are only routed within
+// a datacenter.
+var privateNetwork = mustParseCIDR("192.168.128.0/17")
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// verifyPrivateIP checks that the private IP added to a linode is listed among its addresses and is
+// in the private range.
+func verifyPrivateIP(linodeId int, added string, ips []linodego.FullIPAddress) error {
+	if ip := net.ParseIP(added); ip == nil || !privateNetwork.Contains(ip) {
+		return fmt.Errorf("linode %d got private IP %q, which is not in %s", linodeId, added, privateNetwork)
+	}
+	for _, ip := range ips {
+		if ip.IsPublic == 0 && ip.IPAddress == added {
+			return nil
+		}
+	}
+	return fmt.Errorf("private IP %s of linode %d is not listed among its addresses", added, linodeId)
+}
+
+// checkSameDatacenter fails if a node of the cluster is in another datacenter than dc. Nodes reach
+// each other over their private IPs, which only works within one datacenter.
+func checkSameDatacenter(servers []linodego.Linode, dc *linodego.DataCenter) error {
+	var elsewhere []string
+	for _, s := range servers {
+		if s.DataCenterId != dc.DataCenterId {
+			elsewhere = append(elsewhere, fmt.Sprintf("%s (datacenter %d)", customString(&s.Label), s.DataCenterId))
+		}
+	}
+	if len(elsewhere) == 0 {
+		return nil
+	}
+	sort.Strings(elsewhere)
+	return fmt.Errorf("nodes of cluster %s are not in datacenter %s, so their private IPs can't reach new nodes: %s",
+		spec.Name, dc.Abbr, strings.Join(elsewhere, ", "))
+}
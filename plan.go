@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/appscode/log"
+)
+
+// fakeIDBase is the first ID handed out for objects that only exist in a dry run.
+const fakeIDBase = 900000000
+
+// APICall is a single Linode API call seen by the recorder.
+type APICall struct {
+	Action string
+	Params url.Values
+	// Skipped is set for calls that were answered locally in a dry run instead of being sent.
+	Skipped bool
+}
+
+// recorder is an http.RoundTripper installed behind the linodego Client. It records every API call
+// that goes through the client, so plan and apply share exactly the same code path. In a dry run,
+// calls that would modify the account are not sent; they are answered with fake responses that are
+// good enough for the rest of the code to carry on, while read-only calls still hit the real API.
+type recorder struct {
+	next   http.RoundTripper
+	dryRun bool
+
+	mu           sync.Mutex
+	calls        []APICall
+	lastID       int
+	placeholders map[string]string
+	linodes      map[int]map[string]interface{}
+	ips          map[int][]map[string]interface{}
+	stackScripts []map[string]interface{}
+	resolved     []resolvedID
+}
+
+type resolvedID struct {
+	name string
+	id   int
+}
+
+func newRecorder(next http.RoundTripper, dryRun bool) *recorder {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &recorder{
+		next:         next,
+		dryRun:       dryRun,
+		placeholders: map[string]string{},
+		linodes:      map[int]map[string]interface{}{},
+		ips:          map[int][]map[string]interface{}{},
+	}
+}
+
+// isReadOnly reports whether a Linode API action leaves the account unchanged.
+func isReadOnly(action string) bool {
+	switch action {
+	case "test.echo", "api.spec", "account.info", "account.estimateinvoice":
+		return true
+	}
+	return strings.HasPrefix(action, "avail.") || strings.HasSuffix(action, ".list")
+}
+
+func (r *recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	params, err := requestParams(req)
+	if err != nil {
+		return nil, err
+	}
+	action := params.Get("api_action")
+	recorded := url.Values{}
+	for k, v := range params {
+		switch k {
+		case "api_key", "api_action":
+		case "rootPass":
+			recorded.Set(k, "<redacted>")
+		case "StackScriptUDFResponses":
+			recorded.Set(k, redactUDFResponses(params.Get(k)))
+		default:
+			recorded[k] = v
+		}
+	}
+
+	call := APICall{Action: action, Params: recorded}
+	if !r.dryRun {
+		r.record(call)
+		log.V(2).Infof("Linode API call %s %s", action, recorded.Encode())
+		return r.next.RoundTrip(req)
+	}
+
+	if isReadOnly(action) {
+		r.record(call)
+		r.mu.Lock()
+		data, ok := r.fakeRead(action, params)
+		r.mu.Unlock()
+		if ok {
+			return fakeResponse(req, action, data)
+		}
+		resp, err := r.next.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		return r.mergeFakes(action, resp)
+	}
+
+	call.Skipped = true
+	r.record(call)
+	r.mu.Lock()
+	data := r.fakeWrite(action, params)
+	r.mu.Unlock()
+	return fakeResponse(req, action, data)
+}
+
+// redactUDFResponses hides the values of secret UDFs in the JSON encoded responses of a
+// linode.disk.createfromstackscript call. Responses that can't be decoded are hidden entirely.
+func redactUDFResponses(s string) string {
+	var r UDFResponses
+	if err := json.Unmarshal([]byte(s), &r); err != nil {
+		return "<redacted>"
+	}
+	redacted, err := r.Redacted().JSON()
+	if err != nil {
+		return "<redacted>"
+	}
+	return redacted
+}
+
+// Resolved remembers an ID that was looked up from the live API so it can be shown in the plan.
+func (r *recorder) Resolved(name string, id int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resolved = append(r.resolved, resolvedID{name: name, id: id})
+}
+
+func (r *recorder) record(call APICall) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, call)
+}
+
+// requestParams extracts the API parameters from either the query string or a form encoded body.
+func requestParams(req *http.Request) (url.Values, error) {
+	if req.Body == nil {
+		return req.URL.Query(), nil
+	}
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(b))
+	if len(b) == 0 {
+		return req.URL.Query(), nil
+	}
+	return url.ParseQuery(string(b))
+}
+
+func fakeResponse(req *http.Request, action string, data interface{}) (*http.Response, error) {
+	b, err := json.Marshal(map[string]interface{}{
+		"ERRORARRAY": []interface{}{},
+		"ACTION":     action,
+		"DATA":       data,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(b)),
+		ContentLength: int64(len(b)),
+		Request:       req,
+	}, nil
+}
+
+// newID returns a fake ID for an object of the given kind and remembers a readable placeholder for it.
+func (r *recorder) newID(kind string) int {
+	r.lastID++
+	id := fakeIDBase + r.lastID
+	r.placeholders[strconv.Itoa(id)] = fmt.Sprintf("<new %s %d>", kind, r.lastID)
+	return id
+}
+
+func intParam(params url.Values, key string) int {
+	n, _ := strconv.Atoi(params.Get(key))
+	return n
+}
+
+func (r *recorder) fakeWrite(action string, params url.Values) interface{} {
+	linodeId := intParam(params, "LinodeID")
+	switch action {
+	case "linode.create", "linode.clone":
+		id := r.newID("linode")
+		r.linodes[id] = map[string]interface{}{
+			"LINODEID":     id,
+			"LABEL":        fmt.Sprintf("linode%d", id),
+			"STATUS":       LinodeStatus_BrandNew,
+			"DATACENTERID": intParam(params, "DatacenterID"),
+			"PLANID":       intParam(params, "PlanID"),
+		}
+		r.ips[id] = append(r.ips[id], map[string]interface{}{
+			"LINODEID":    id,
+			"ISPUBLIC":    1,
+			"IPADDRESS":   fmt.Sprintf("203.0.113.%d", r.lastID%256),
+			"IPADDRESSID": r.newID("ip"),
+		})
+		return map[string]int{"LinodeID": id}
+	case "linode.update":
+		if l, ok := r.linodes[linodeId]; ok {
+			if v := params.Get("Label"); v != "" {
+				l["LABEL"] = v
+			}
+			if v := params.Get("lpm_displayGroup"); v != "" {
+				l["LPM_DISPLAYGROUP"] = v
+			}
+		}
+		return map[string]int{"LinodeID": linodeId}
+	case "linode.delete":
+		delete(r.linodes, linodeId)
+		return map[string]int{"LinodeID": linodeId}
+	case "linode.boot", "linode.reboot":
+		if l, ok := r.linodes[linodeId]; ok {
+			l["STATUS"] = LinodeStatus_Running
+		}
+		return map[string]int{"JobID": r.newID("job")}
+	case "linode.shutdown":
+		if l, ok := r.linodes[linodeId]; ok {
+			l["STATUS"] = LinodeStatus_PoweredOff
+		}
+		return map[string]int{"JobID": r.newID("job")}
+	case "linode.ip.addprivate", "linode.ip.addpublic":
+		id := r.newID("ip")
+		public := 0
+		address := fmt.Sprintf("192.168.128.%d", r.lastID%256)
+		if action == "linode.ip.addpublic" {
+			public = 1
+			address = fmt.Sprintf("203.0.113.%d", r.lastID%256)
+		}
+		r.ips[linodeId] = append(r.ips[linodeId], map[string]interface{}{
+			"LINODEID":    linodeId,
+			"ISPUBLIC":    public,
+			"IPADDRESS":   address,
+			"IPADDRESSID": id,
+		})
+		return map[string]interface{}{"IPAddressID": id, "IPAddress": address}
+	case "linode.ip.setrdns":
+		return map[string]interface{}{
+			"HOSTNAME":    params.Get("Hostname"),
+			"IPADDRESSID": intParam(params, "IPAddressID"),
+		}
+	case "linode.config.create":
+		return map[string]int{"ConfigID": r.newID("config")}
+	case "linode.config.update", "linode.config.delete":
+		return map[string]int{"ConfigID": intParam(params, "ConfigID")}
+	case "stackscript.create":
+		id := r.newID("stackscript")
+		r.stackScripts = append(r.stackScripts, map[string]interface{}{
+			"STACKSCRIPTID":      id,
+			"LABEL":              params.Get("Label"),
+			"SCRIPT":             params.Get("script"),
+			"DISTRIBUTIONIDLIST": params.Get("DistributionIDList"),
+		})
+		return map[string]int{"StackScriptID": id}
+	case "stackscript.update", "stackscript.delete":
+		return map[string]int{"StackScriptID": intParam(params, "StackScriptID")}
+	}
+	if strings.HasPrefix(action, "linode.disk.") {
+		diskId := intParam(params, "DiskID")
+		if strings.HasPrefix(action, "linode.disk.create") || action == "linode.disk.duplicate" {
+			diskId = r.newID("disk")
+		}
+		return map[string]int{"JobID": r.newID("job"), "DiskID": diskId}
+	}
+	return map[string]interface{}{}
+}
+
+// fakeRead answers read-only calls about objects that only exist in the dry run.
+func (r *recorder) fakeRead(action string, params url.Values) (interface{}, bool) {
+	linodeId := intParam(params, "LinodeID")
+	if linodeId < fakeIDBase {
+		return nil, false
+	}
+	switch action {
+	case "linode.list":
+		if l, ok := r.linodes[linodeId]; ok {
+			return []interface{}{copyObject(l)}, true
+		}
+		return []interface{}{}, true
+	case "linode.ip.list":
+		return r.ips[linodeId], true
+	case "linode.job.list":
+		// Jobs of fake linodes finish immediately and successfully.
+		return []interface{}{map[string]interface{}{
+			"JOBID":          intParam(params, "JobID"),
+			"LINODEID":       linodeId,
+			"HOST_SUCCESS":   1,
+			"HOST_FINISH_DT": time.Now().Format("2006-01-02 15:04:05.0"),
+		}}, true
+	}
+	return []interface{}{}, true
+}
+
+// copyObject returns a shallow copy of a fake object so it can be encoded outside of the lock.
+func copyObject(o map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(o))
+	for k, v := range o {
+		c[k] = v
+	}
+	return c
+}
+
+// mergeFakes adds the objects created during the dry run to the real list responses.
+func (r *recorder) mergeFakes(action string, resp *http.Response) (*http.Response, error) {
+	var fakes []map[string]interface{}
+	r.mu.Lock()
+	switch action {
+	case "linode.list":
+		for _, l := range r.linodes {
+			fakes = append(fakes, copyObject(l))
+		}
+	case "stackscript.list":
+		fakes = append(fakes, r.stackScripts...)
+	}
+	r.mu.Unlock()
+	if len(fakes) == 0 || resp.StatusCode != http.StatusOK {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var body struct {
+		Errors []json.RawMessage `json:"ERRORARRAY"`
+		Data   []json.RawMessage `json:"DATA"`
+	}
+	if err := json.Unmarshal(b, &body); err != nil || len(body.Errors) > 0 {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+		return resp, nil
+	}
+	data := make([]interface{}, 0, len(body.Data)+len(fakes))
+	for _, d := range body.Data {
+		data = append(data, d)
+	}
+	for _, f := range fakes {
+		data = append(data, f)
+	}
+	return fakeResponse(resp.Request, action, data)
+}
+
+// placeholder replaces fake IDs in a parameter value with a readable name.
+func (r *recorder) placeholder(v string) string {
+	parts := strings.Split(v, ",")
+	for i, p := range parts {
+		if name, ok := r.placeholders[p]; ok {
+			parts[i] = name
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// printDryRun reports the IDs resolved from the live API and every call that a dry run skipped.
+func printDryRun(w io.Writer, r *recorder) {
+	r.mu.Lock()
+	fmt.Fprintln(w, "Resolved:")
+	for _, id := range r.resolved {
+		fmt.Fprintf(w, "  %-12s = %s\n", id.name, r.placeholder(strconv.Itoa(id.id)))
+	}
+	r.mu.Unlock()
+
+	fmt.Fprintln(w, "\nLinode API calls that would be made:")
+	r.PrintPlan(w)
+}
+
+// PrintPlan writes the calls that were skipped in a dry run, in the order they would have been made.
+func (r *recorder) PrintPlan(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for _, c := range r.calls {
+		if !c.Skipped {
+			continue
+		}
+		n++
+		keys := make([]string, 0, len(c.Params))
+		for k := range c.Params {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fmt.Fprintf(w, "%3d. %s\n", n, c.Action)
+		for _, k := range keys {
+			v := c.Params.Get(k)
+			if lines := strings.Count(v, "\n"); lines > 0 {
+				v = fmt.Sprintf("<%d lines>", lines+1)
+			}
+			fmt.Fprintf(w, "       %s = %s\n", k, r.placeholder(v))
+		}
+	}
+	if n == 0 {
+		fmt.Fprintln(w, "No changes.")
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/tamalsaha/go-oneliners"
+	"github.com/taoh/linodego"
+)
+
+var parallel = flag.Int("parallel", 4, "Maximum number of nodes provisioned concurrently")
+
+// provisioner holds everything needed to create nodes that is resolved once per run. It is not
+// modified after newProvisioner returns, so its methods are safe to call from many goroutines.
+type provisioner struct {
+	client        *linodego.Client
+	kernel        int
+	instanceImage int
+	roles         map[string]*roleSetup
+	disks         map[string]*DiskPlan
+	progress      *progress
+	state         *stateStore
+	naming        NamingStrategy
+	labels        *labelRegistry
+	sshKey        *SSHKey
+	secrets       *secretBox
+	joinToken     string
+}
+
+// roleSetup is what the nodes of a role are created with.
+type roleSetup struct {
+	config   NodeConfig
+	plan     *ResolvedPlan
+	script   *StackScript
+	scriptId int
+}
+
+// newProvisioner resolves the distribution and kernel, checks that the existing nodes are in the
+// datacenter of the spec, renders and syncs the StackScripts of the roles of the pools, sizes the
+// disks of the pools and loads the cluster's SSH key and kubeadm token. Created nodes are recorded
+// in st.
+func newProvisioner(c *linodego.Client, st *stateStore) (*provisioner, error) {
+	p := &provisioner{client: c, progress: &progress{}, state: st}
+
+	distro, err := resolveDistribution()
+	if err != nil {
+		return nil, err
+	}
+	p.instanceImage = distro.DistributionId
+	oneliners.FILE("InstanceImage = ", p.instanceImage)
+
+	kernel, err := resolveKernel(distro)
+	if err != nil {
+		return nil, err
+	}
+	p.kernel = kernel.KernelId
+	oneliners.FILE("Kernel = ", p.kernel, kernel.Label.String())
+
+	p.naming, err = namingStrategy(spec.Naming)
+	if err != nil {
+		return nil, err
+	}
+	dc, err := resolveDatacenter()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Linode.List(0)
+	if err != nil {
+		return nil, err
+	}
+	labels := make([]string, 0, len(resp.Linodes))
+	// Only confirmed members must share the datacenter; a linode that merely has a label of the
+	// cluster may belong to someone else and is only warned about.
+	var nodes []linodego.Linode
+	for _, s := range resp.Linodes {
+		labels = append(labels, s.Label.String())
+		switch {
+		case !isClusterNode(s):
+		case matchedByLabelOnly(st, s):
+			if s.DataCenterId != dc.DataCenterId {
+				fmt.Printf("warning: linode %d (%s) is named like a node of cluster %s but is in datacenter %d, not %s; it is ignored\n",
+					s.LinodeId, s.Label.String(), spec.Name, s.DataCenterId, dc.Abbr)
+			}
+		default:
+			nodes = append(nodes, s)
+		}
+	}
+	p.labels = newLabelRegistry(labels)
+	if err := checkSameDatacenter(nodes, dc); err != nil {
+		return nil, err
+	}
+
+	// Roles without a template of their own share the cluster's script, which is synced once.
+	p.roles = map[string]*roleSetup{}
+	var scripts []*StackScript
+	for _, cfg := range spec.nodeConfigs() {
+		setup := &roleSetup{config: cfg}
+		setup.plan, err = resolveRolePlan(cfg.Role)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range scripts {
+			if s.Label == cfg.Script.Name {
+				setup.script = s
+			}
+		}
+		if setup.script == nil {
+			setup.script, err = renderStackScript(cfg)
+			if err != nil {
+				return nil, err
+			}
+			scripts = append(scripts, setup.script)
+		}
+		p.roles[cfg.Role] = setup
+	}
+
+	// Catch bad UDF values and disk layouts before any linode is created; the addresses are only
+	// known later.
+	p.disks = map[string]*DiskPlan{}
+	for i := range spec.NodePools {
+		pool := &spec.NodePools[i]
+		p.disks[pool.Name], err = spec.PoolConfig(pool).DiskPlan()
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %v", pool.Name, err)
+		}
+		var join *JoinInfo
+		if spec.Kubernetes != nil {
+			join = &JoinInfo{Token: "pending"}
+		}
+		script := p.roles[pool.Role].script
+		r := script.UDFResponses(&NodeRecord{}, pool, join)
+		if err := validateUDFResponses(script.UDFs, r, UDFHostname, UDFPrivateIP, UDFPublicIP, UDFMasterIP); err != nil {
+			return nil, fmt.Errorf("pool %s: %v", pool.Name, err)
+		}
+	}
+
+	for _, s := range scripts {
+		scriptId, err := createOrUpdateStackScript(p.instanceImage, s)
+		if err != nil {
+			return nil, err
+		}
+		oneliners.FILE("scriptId = ", scriptId, s.Label)
+		for _, setup := range p.roles {
+			if setup.script == s {
+				setup.scriptId = scriptId
+			}
+		}
+	}
+
+	p.sshKey, err = loadOrCreateSSHKey()
+	if err != nil {
+		return nil, err
+	}
+
+	// Generated secrets are not stored in a dry run, so a missing key is not an error there.
+	p.secrets, err = newSecretBox()
+	if err != nil && !*dryRun {
+		return nil, err
+	}
+	if spec.Kubernetes != nil {
+		p.joinToken, err = loadOrCreateJoinToken(st, p.secrets)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if rec, ok := c.HTTPClient.Transport.(*recorder); ok {
+		rec.Resolved("datacenter", dc.DataCenterId)
+		rec.Resolved("kernel", p.kernel)
+		rec.Resolved("distribution", p.instanceImage)
+		for _, cfg := range spec.nodeConfigs() {
+			suffix := ""
+			if cfg.Role != "" {
+				suffix = "[" + cfg.Role + "]"
+			}
+			rec.Resolved("plan"+suffix, p.roles[cfg.Role].plan.PlanId)
+			rec.Resolved("stackscript"+suffix, p.roles[cfg.Role].scriptId)
+		}
+	}
+	return p, nil
+}
+
+// createNode creates, provisions and boots a single linode in the given node pool. If any step
+// fails, everything created so far is removed again unless -keep-failed is set.
+func (p *provisioner) createNode(task string, pool *NodePool) (*NodeRecord, error) {
+	rb := &rollback{}
+	node, err := p.provisionNode(task, pool, rb)
+	if err == nil {
+		if err = p.state.Put(node); err != nil {
+			err = fmt.Errorf("node %s was created but could not be recorded in the state: %v", node.Name, err)
+		}
+		p.progress.Finish(task, err)
+		return node, err
+	}
+	if *keepFailed {
+		err = fmt.Errorf("%v (kept partially created linode for debugging)", err)
+	} else if failed := rb.Run(); failed > 0 {
+		err = fmt.Errorf("%v (rollback incomplete, %d steps failed)", err, failed)
+	} else {
+		err = fmt.Errorf("%v (rolled back)", err)
+	}
+	p.progress.Finish(task, err)
+	return node, err
+}
+
+// NodeResult is the outcome of creating one node with createNodes.
+type NodeResult struct {
+	Pool string
+	Node *NodeRecord
+	Err  error
+}
+
+// createNodes creates one node for every entry of pools, running at most -parallel at a time.
+// Results are returned in the same order as pools.
+func (p *provisioner) createNodes(pools []*NodePool) []NodeResult {
+	workers := *parallel
+	if workers < 1 {
+		workers = 1
+	}
+	p.progress.Start(len(pools))
+
+	results := make([]NodeResult, len(pools))
+	sem := make(chan struct{}, workers)
+	perPool := map[string]int{}
+	var wg sync.WaitGroup
+	for i, pool := range pools {
+		perPool[pool.Name]++
+		task := fmt.Sprintf("%s#%d", pool.Name, perPool[pool.Name])
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, task string, pool *NodePool) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			node, err := p.createNode(task, pool)
+			results[i] = NodeResult{Pool: pool.Name, Node: node, Err: err}
+		}(i, task, pool)
+	}
+	wg.Wait()
+	return results
+}
+
+// NodeErrors aggregates the failures of a createNodes run.
+type NodeErrors []NodeResult
+
+func (e NodeErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, r := range e {
+		name := r.Pool
+		if r.Node != nil && r.Node.Name != "" {
+			name += "/" + r.Node.Name
+		}
+		msgs = append(msgs, fmt.Sprintf("%s: %v", name, r.Err))
+	}
+	return fmt.Sprintf("%d nodes failed:\n  %s", len(e), strings.Join(msgs, "\n  "))
+}
+
+// failedNodes returns an error listing every failed result, or nil if all of them succeeded.
+func failedNodes(results []NodeResult) error {
+	var errs NodeErrors
+	for _, r := range results {
+		if r.Err != nil {
+			errs = append(errs, r)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// progress prints a combined view of the nodes being provisioned concurrently.
+type progress struct {
+	mu     sync.Mutex
+	total  int
+	done   int
+	failed int
+}
+
+func (pr *progress) Start(total int) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.total, pr.done, pr.failed = total, 0, 0
+}
+
+// Step reports that task entered a new phase.
+func (pr *progress) Step(task, phase string) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	fmt.Printf("[%s] %-16s %s\n", pr.counts(), task, phase)
+}
+
+// Finish reports that task completed, successfully if err is nil.
+func (pr *progress) Finish(task string, err error) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	phase := "done"
+	if err != nil {
+		pr.failed++
+		phase = "failed: " + err.Error()
+	} else {
+		pr.done++
+	}
+	fmt.Printf("[%s] %-16s %s\n", pr.counts(), task, phase)
+}
+
+func (pr *progress) counts() string {
+	if pr.total == 0 {
+		return fmt.Sprintf("%d done, %d failed", pr.done, pr.failed)
+	}
+	return fmt.Sprintf("%d/%d done, %d failed", pr.done, pr.total, pr.failed)
+}
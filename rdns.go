@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/taoh/linodego"
+)
+
+var domainRegexp = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,}$`)
+
+// nodeFQDN returns the reverse DNS name of a node: its label in the cluster domain.
+func nodeFQDN(name string) string {
+	return strings.ToLower(name) + "." + spec.Domain
+}
+
+// sameHostname compares DNS names, ignoring case and the trailing dot.
+func sameHostname(a, b string) bool {
+	return strings.EqualFold(strings.TrimSuffix(a, "."), strings.TrimSuffix(b, "."))
+}
+
+// setRDNS points the reverse DNS of a public IP of linodeId at hostname and checks that Ip.List
+// reports the new name. Linode only accepts names whose forward DNS resolves to the IP. A dry run
+// sets nothing, so there is nothing to check.
+func setRDNS(c *linodego.Client, linodeId, ipAddressId int, hostname string) error {
+	if _, err := c.Ip.SetRDNS(ipAddressId, hostname); err != nil {
+		return fmt.Errorf("failed to set reverse DNS to %s: %v", hostname, err)
+	}
+	if *dryRun {
+		return nil
+	}
+	resp, err := c.Ip.List(linodeId, ipAddressId)
+	if err != nil {
+		return err
+	}
+	for _, ip := range resp.FullIPAddresses {
+		if ip.IPAddressId != ipAddressId {
+			continue
+		}
+		if !sameHostname(ip.RDNSName, hostname) {
+			return fmt.Errorf("reverse DNS of %s is %q after setting it to %s", ip.IPAddress, ip.RDNSName, hostname)
+		}
+		return nil
+	}
+	return fmt.Errorf("IP %d of linode %d is not listed", ipAddressId, linodeId)
+}
+
+// cmdRDNS reports the nodes whose public IPs have a reverse DNS name other than
+// <label>.<domain>. With -fix, their reverse DNS is set again.
+func cmdRDNS(args []string) error {
+	fs := newFlagSet("rdns", "")
+	fix := fs.Bool("fix", false, "Set the reverse DNS of the nodes that drifted")
+	if err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	if spec.Domain == "" {
+		return fmt.Errorf("cluster %s has no domain in its spec, so its nodes have no reverse DNS name", spec.Name)
+	}
+	servers, err := listClusterNodes()
+	if err != nil {
+		return err
+	}
+
+	drifted := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tPUBLIC IP\tREVERSE DNS\tSTATUS")
+	for _, s := range servers {
+		ips, err := client.Ip.List(s.LinodeId, -1)
+		if err != nil {
+			return err
+		}
+		want := nodeFQDN(s.Label.String())
+		for _, ip := range ips.FullIPAddresses {
+			if ip.IsPublic != 1 {
+				continue
+			}
+			status := "ok"
+			if !sameHostname(ip.RDNSName, want) {
+				drifted++
+				status = "drifted, want " + want
+				if *fix {
+					if err := setRDNS(client, s.LinodeId, ip.IPAddressId, want); err != nil {
+						status = err.Error()
+					} else {
+						drifted--
+						status = "fixed"
+					}
+				}
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Label.String(), ip.IPAddress, ip.RDNSName, status)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if drifted > 0 {
+		hint := ", use -fix to set it again"
+		if *fix {
+			hint = ""
+		}
+		return fmt.Errorf("reverse DNS of %d public IPs does not match the node label%s", drifted, hint)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/taoh/linodego"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+var (
+	bootTimeout    = flag.Duration("boot-timeout", 5*time.Minute, "How long to wait for the boot job of a new node to finish")
+	runningTimeout = flag.Duration("running-timeout", 2*time.Minute, "How long to wait for a booted node to report status Running")
+	sshTimeout     = flag.Duration("ssh-timeout", 5*time.Minute, "How long to wait for port 22 of a new node to accept connections")
+	sshBanner      = flag.Bool("ssh-banner", false, "Also wait for the SSH server of a new node to send its identification banner")
+	probePrivate   = flag.Bool("probe-private", false, "Also wait for port 22 of the private IP of a new node to accept connections; only works from a linode in the same datacenter")
+)
+
+// probeTimeout bounds a single connection attempt, so that a filtered port does not use up the
+// whole phase timeout in one try.
+const probeTimeout = 10 * time.Second
+
+// readinessCheck reports whether a phase is complete. status describes what was observed and is
+// used to explain a timeout; a non-nil error aborts the wait.
+type readinessCheck func() (ready bool, status string, err error)
+
+type readinessPhase struct {
+	name    string
+	timeout time.Duration
+	check   readinessCheck
+}
+
+// ReadinessError reports the phase in which a new node stalled.
+type ReadinessError struct {
+	Phase   string
+	Timeout time.Duration
+	Status  string
+}
+
+func (e *ReadinessError) Error() string {
+	return fmt.Sprintf("node stalled waiting for %s: not done after %v, last status: %s", e.Phase, e.Timeout, e.Status)
+}
+
+// waitReady waits until a freshly booted node is usable: its boot job finished, it reports
+// status Running and its SSH port accepts connections, on the private IP too with -probe-private.
+// In a dry run there is no machine to connect to, so the network probes are skipped.
+func (p *provisioner) waitReady(task string, node *NodeRecord, bootJobId int) error {
+	phases := []readinessPhase{
+		{"boot job", *bootTimeout, p.jobFinished(node.LinodeID, bootJobId)},
+		{"status Running", *runningTimeout, p.hasStatus(node.LinodeID, LinodeStatus_Running)},
+	}
+	if !*dryRun {
+		addr := net.JoinHostPort(node.PublicIP, "22")
+		phases = append(phases, readinessPhase{"tcp/22", *sshTimeout, probeTCP(addr)})
+		if *sshBanner {
+			phases = append(phases, readinessPhase{"ssh banner", *sshTimeout, probeSSHBanner(addr)})
+		}
+		// The network helper brings the private IP up at boot.
+		if *probePrivate {
+			phases = append(phases, readinessPhase{"private tcp/22", *sshTimeout, probeTCP(net.JoinHostPort(node.PrivateIP, "22"))})
+		}
+	}
+
+	for _, ph := range phases {
+		p.progress.Step(task, "waiting for "+ph.name)
+		last := "no response yet"
+		err := wait.PollImmediate(RetryInterval, ph.timeout, func() (bool, error) {
+			ready, status, err := ph.check()
+			if status != "" {
+				last = status
+			}
+			return ready, err
+		})
+		if err == wait.ErrWaitTimeout {
+			return &ReadinessError{Phase: ph.name, Timeout: ph.timeout, Status: last}
+		}
+		if err != nil {
+			return fmt.Errorf("waiting for %s: %v", ph.name, err)
+		}
+	}
+	return nil
+}
+
+func (p *provisioner) jobFinished(linodeId, jobId int) readinessCheck {
+	return func() (bool, string, error) {
+		resp, err := p.client.Job.List(linodeId, jobId, false)
+		if err != nil {
+			return false, err.Error(), nil
+		}
+		for _, j := range resp.Jobs {
+			if j.JobId != jobId {
+				continue
+			}
+			if !j.HostFinishDt.IsSet() {
+				return false, fmt.Sprintf("job %d is pending", jobId), nil
+			}
+			if !jobSucceeded(&j) {
+				return false, "", fmt.Errorf("job %d (%s) failed: %s", jobId, j.Action, j.HostMessage)
+			}
+			return true, "", nil
+		}
+		return false, fmt.Sprintf("job %d is not listed yet", jobId), nil
+	}
+}
+
+// jobSucceeded checks HOST_SUCCESS, which the API sets to 1 on success and to "" otherwise.
+func jobSucceeded(j *linodego.Job) bool {
+	return customString(&j.HostSuccess) == "1"
+}
+
+func (p *provisioner) hasStatus(linodeId, status int) readinessCheck {
+	return func() (bool, string, error) {
+		resp, err := p.client.Linode.List(linodeId)
+		if err != nil {
+			return false, err.Error(), nil
+		}
+		if len(resp.Linodes) == 0 {
+			return false, fmt.Sprintf("linode %d is not listed", linodeId), nil
+		}
+		current := resp.Linodes[0].Status
+		return current == status, "status is " + statusString(current), nil
+	}
+}
+
+func probeTCP(addr string) readinessCheck {
+	return func() (bool, string, error) {
+		conn, err := net.DialTimeout("tcp", addr, probeTimeout)
+		if err != nil {
+			return false, err.Error(), nil
+		}
+		conn.Close()
+		return true, "", nil
+	}
+}
+
+// probeSSHBanner waits for the "SSH-" identification line every SSH server sends first. The
+// server may send other lines before it, see RFC 4253 section 4.2.
+func probeSSHBanner(addr string) readinessCheck {
+	return func() (bool, string, error) {
+		conn, err := net.DialTimeout("tcp", addr, probeTimeout)
+		if err != nil {
+			return false, err.Error(), nil
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(probeTimeout))
+		r := bufio.NewReader(conn)
+		for i := 0; i < 10; i++ {
+			line, err := r.ReadString('\n')
+			if strings.HasPrefix(line, "SSH-") {
+				return true, "", nil
+			}
+			if err != nil {
+				return false, "no SSH banner: " + err.Error(), nil
+			}
+		}
+		return false, "no SSH banner in the first lines sent by the server", nil
+	}
+}
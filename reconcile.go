@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/taoh/linodego"
+)
+
+const (
+	ActionCreate = "create"
+	ActionDelete = "delete"
+	ActionSkip   = "skip"
+)
+
+// ReconcileAction records a single step taken (or deliberately not taken) by reconcile.
+type ReconcileAction struct {
+	Action string
+	Pool   string
+	Node   string
+	Reason string
+	Err    error
+}
+
+// displayGroup is the Linode display group used to tag the nodes of a pool.
+func displayGroup(pool string) string {
+	return spec.Name + "/" + pool
+}
+
+// poolOf returns the pool recorded in the display group of a cluster node, or "" if it has none.
+func poolOf(server linodego.Linode) string {
+	if !strings.HasPrefix(server.LpmDisplayGroup, spec.Name+"/") {
+		return ""
+	}
+	return strings.TrimPrefix(server.LpmDisplayGroup, spec.Name+"/")
+}
+
+// isClusterNode reports whether a linode belongs to this cluster: it is in one of the cluster's
+// display groups, or it has no display group and a label the naming strategy of the spec could
+// have given it. A label prefix alone is not enough, the nodes of cluster c1-prod start with "c1-"
+// too.
+func isClusterNode(s linodego.Linode) bool {
+	if s.LpmDisplayGroup != "" {
+		return poolOf(s) != ""
+	}
+	return namedByStrategy(s.Label.String())
+}
+
+// matchedByLabelOnly reports whether a cluster node is only known by its label: it has no display
+// group and is not recorded in the state. Such nodes may be someone else's, so reconcile neither
+// counts nor deletes them.
+func matchedByLabelOnly(st *stateStore, s linodego.Linode) bool {
+	return s.LpmDisplayGroup == "" && st.Find("", s.LinodeId) == nil
+}
+
+// reconcile creates or deletes nodes until each node pool has the number of nodes requested in the
+// spec. Nodes of pools that were removed from the spec are reported and deleted only if prune is
+// set. Every action is returned, including the failed ones, so callers can report what happened
+// even if an error is returned.
+func reconcile(st *stateStore, prune bool) ([]ReconcileAction, error) {
+	servers, err := listClusterNodes()
+	if err != nil {
+		return nil, err
+	}
+
+	// Nodes without a display group predate node pools; they count towards the pool recorded in the
+	// state, or else the default pool.
+	byPool := map[string][]linodego.Linode{}
+	var labelOnly []linodego.Linode
+	for _, s := range servers {
+		if matchedByLabelOnly(st, s) {
+			labelOnly = append(labelOnly, s)
+			continue
+		}
+		pool := poolOf(s)
+		if pool == "" {
+			if n := st.Find("", s.LinodeId); n != nil {
+				pool = n.Pool
+			}
+		}
+		if pool == "" {
+			pool = spec.NodePools[0].Name
+		}
+		byPool[pool] = append(byPool[pool], s)
+	}
+
+	var creates []*NodePool
+	for i := range spec.NodePools {
+		pool := &spec.NodePools[i]
+		for n := len(byPool[pool.Name]); n < pool.Count; n++ {
+			creates = append(creates, pool)
+		}
+	}
+	// Nothing is changed until the cost of the new nodes is confirmed.
+	if err := confirmCost(creates); err != nil {
+		return nil, err
+	}
+
+	var actions []ReconcileAction
+	for _, s := range labelOnly {
+		actions = append(actions, ReconcileAction{
+			Action: ActionSkip,
+			Node:   s.Label.String(),
+			Reason: "only its label marks it as a node of the cluster, so it is not counted; delete it by hand or import it",
+		})
+	}
+	for i := range spec.NodePools {
+		pool := &spec.NodePools[i]
+		existing := byPool[pool.Name]
+		delete(byPool, pool.Name)
+		if len(existing) > pool.Count {
+			actions = append(actions, deleteNodes(st, pool.Name, existing, len(existing)-pool.Count, "scale down")...)
+		}
+	}
+
+	if len(creates) > 0 {
+		p, err := newProvisioner(client, st)
+		if err != nil {
+			return actions, err
+		}
+		// Workers join the Kubernetes master, so it is created first.
+		var masters, others []*NodePool
+		for _, pool := range creates {
+			if spec.Kubernetes != nil && pool.Role == RoleMaster {
+				masters = append(masters, pool)
+			} else {
+				others = append(others, pool)
+			}
+		}
+		for _, batch := range [][]*NodePool{masters, others} {
+			if len(batch) == 0 {
+				continue
+			}
+			for _, r := range p.createNodes(batch) {
+				a := ReconcileAction{Action: ActionCreate, Pool: r.Pool, Err: r.Err}
+				if r.Node != nil {
+					a.Node = r.Node.Name
+				}
+				actions = append(actions, a)
+			}
+		}
+	}
+
+	for pool, existing := range byPool {
+		if prune {
+			actions = append(actions, deleteNodes(st, pool, existing, len(existing), "pool removed from spec")...)
+			continue
+		}
+		for _, s := range existing {
+			actions = append(actions, ReconcileAction{
+				Action: ActionSkip,
+				Pool:   pool,
+				Node:   s.Label.String(),
+				Reason: "pool not in spec, use -prune to delete",
+			})
+		}
+	}
+
+	failed := 0
+	for _, a := range actions {
+		if a.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return actions, fmt.Errorf("%d of %d reconcile actions failed", failed, len(actions))
+	}
+	return actions, nil
+}
+
+// deleteNodes deletes the n most recently created linodes among servers and drops them from the
+// state.
+func deleteNodes(st *stateStore, pool string, servers []linodego.Linode, n int, reason string) []ReconcileAction {
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].LinodeId > servers[j].LinodeId
+	})
+	actions := make([]ReconcileAction, 0, n)
+	for _, s := range servers[:n] {
+		_, err := client.Linode.Delete(s.LinodeId, true)
+		if err == nil {
+			err = st.Remove(s.LinodeId)
+		}
+		actions = append(actions, ReconcileAction{
+			Action: ActionDelete,
+			Pool:   pool,
+			Node:   s.Label.String(),
+			Reason: reason,
+			Err:    err,
+		})
+	}
+	return actions
+}
+
+func printActions(actions []ReconcileAction) {
+	if len(actions) == 0 {
+		fmt.Println("Cluster is up to date")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ACTION\tPOOL\tNODE\tRESULT")
+	for _, a := range actions {
+		result := "ok"
+		if a.Err != nil {
+			result = "error: " + a.Err.Error()
+		}
+		if a.Reason != "" {
+			result += " (" + a.Reason + ")"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", a.Action, a.Pool, a.Node, result)
+	}
+	w.Flush()
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Node roles. A pool without a role uses the cluster wide settings of the spec.
+const (
+	RoleMaster  = "master"
+	RoleWorker  = "worker"
+	RoleEtcd    = "etcd"
+	RoleIngress = "ingress"
+)
+
+var nodeRoles = []string{RoleMaster, RoleWorker, RoleEtcd, RoleIngress}
+
+// RoleSpec overrides the cluster wide settings for the nodes of the pools with a role. Fields that
+// are not set are inherited from the cluster.
+type RoleSpec struct {
+	Plan   string      `json:"plan,omitempty"`
+	Disks  *DiskLayout `json:"disks,omitempty"`
+	Script *RoleScript `json:"script,omitempty"`
+}
+
+// RoleScript gives a role its own StackScript template, labelled <script.name>-<role>, or only its
+// own UDF values, which are merged over the cluster's.
+type RoleScript struct {
+	Template string            `json:"template,omitempty"`
+	UDFs     map[string]string `json:"udfs,omitempty"`
+}
+
+// NodeConfig is what the nodes of a role are created with, after applying the role's overrides
+// to the cluster wide settings.
+type NodeConfig struct {
+	Role   string
+	Plan   string
+	Disks  DiskLayout
+	Script ScriptSpec
+}
+
+// NodeConfig returns the configuration of the nodes with the given role.
+func (s *ClusterSpec) NodeConfig(role string) NodeConfig {
+	c := NodeConfig{
+		Role:   role,
+		Plan:   s.Plan,
+		Disks:  s.Disks,
+		Script: s.Script,
+	}
+	r, ok := s.Roles[role]
+	if !ok {
+		return c
+	}
+	if r.Plan != "" {
+		c.Plan = r.Plan
+	}
+	if r.Disks != nil {
+		c.Disks = *r.Disks
+	}
+	if r.Script != nil {
+		if r.Script.Template != "" {
+			c.Script.Name = s.Script.Name + "-" + role
+			c.Script.Template = r.Script.Template
+		}
+		udfs := map[string]string{}
+		for k, v := range s.Script.UDFs {
+			udfs[k] = v
+		}
+		for k, v := range r.Script.UDFs {
+			udfs[k] = v
+		}
+		c.Script.UDFs = udfs
+	}
+	return c
+}
+
+// nodeConfigs returns the configuration of every role used by a pool, in the order of the pools.
+func (s *ClusterSpec) nodeConfigs() []NodeConfig {
+	var configs []NodeConfig
+	seen := map[string]bool{}
+	for _, p := range s.NodePools {
+		if !seen[p.Role] {
+			seen[p.Role] = true
+			configs = append(configs, s.NodeConfig(p.Role))
+		}
+	}
+	return configs
+}
+
+// PoolConfig returns the configuration of the nodes of pool: that of its role, with the pool's own
+// disk layout if it has one.
+func (s *ClusterSpec) PoolConfig(pool *NodePool) NodeConfig {
+	c := s.NodeConfig(pool.Role)
+	if pool.Disks != nil {
+		c.Disks = *pool.Disks
+	}
+	return c
+}
+
+// DiskPlan sizes the disks of the nodes for the live plan.
+func (c NodeConfig) DiskPlan() (*DiskPlan, error) {
+	p, err := resolvePlan(c.Plan)
+	if err != nil {
+		return nil, err
+	}
+	return planDisks(c.Disks, p)
+}
+
+func (s *ClusterSpec) validateRoles(errs *FieldErrors) {
+	roles := make([]string, 0, len(s.Roles))
+	for role := range s.Roles {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	for _, role := range roles {
+		r := s.Roles[role]
+		field := "roles." + role
+		if !containsString(nodeRoles, role) {
+			errs.Add("roles", "unknown role %q", role)
+			continue
+		}
+		if r.Plan != "" {
+			if err := validatePlanSelector(r.Plan); err != nil {
+				errs.Add(field+".plan", "%v", err)
+			}
+		}
+		if r.Disks != nil {
+			validateDiskLayout(errs, field+".disks", r.Disks)
+		}
+		if r.Script != nil {
+			validateUDFValues(errs, field+".script.udfs", r.Script.UDFs)
+		}
+	}
+	for i, p := range s.NodePools {
+		if p.Role != "" && !containsString(nodeRoles, p.Role) {
+			errs.Add(fmt.Sprintf("nodePools[%d].role", i), "unknown role %q", p.Role)
+		}
+	}
+}
+
+// roleSuffix qualifies a message about the nodes of role, e.g. " of role master".
+func roleSuffix(role string) string {
+	if role == "" {
+		return ""
+	}
+	return " of role " + role
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+var keepFailed = flag.Bool("keep-failed", false, "Keep half-built linodes for debugging instead of rolling them back")
+
+// rollback collects compensating actions for the steps of a multi-step operation, so that a
+// failure part way through does not leave billable resources behind.
+type rollback struct {
+	steps []rollbackStep
+}
+
+type rollbackStep struct {
+	desc string
+	undo func() error
+}
+
+// Add registers undo to be run if the operation fails. Steps are undone in reverse order.
+func (r *rollback) Add(desc string, undo func() error) {
+	r.steps = append(r.steps, rollbackStep{desc: desc, undo: undo})
+}
+
+// Run undoes all registered steps, newest first. It keeps going when a step fails, since the
+// remaining steps usually still release resources, and returns the number of failed steps.
+func (r *rollback) Run() int {
+	failed := 0
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		s := r.steps[i]
+		if err := s.undo(); err != nil {
+			fmt.Printf("Rollback: failed to %s: %v\n", s.desc, err)
+			failed++
+			continue
+		}
+		fmt.Printf("Rollback: %s\n", s.desc)
+	}
+	r.steps = nil
+	return failed
+}
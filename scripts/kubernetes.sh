@@ -0,0 +1,75 @@
+#!/bin/bash
+{{/*
+Default template when the spec has a kubernetes section. .Kubernetes.Version and .Kubernetes.Apps
+come from the appscode/data catalog, .Kubernetes.Downloads holds the URLs of the apps installed
+here; .Kubernetes.MasterIP and .Kubernetes.Token are filled in per node like the .Node fields.
+kubeadm, kubelet and kubectl come from the kubernetes-server release, so only versions kubeadm can
+bootstrap are accepted. The master runs kubeadm init, all other nodes join it.
+*/ -}}
+# Kubernetes {{.Kubernetes.Version}} node of cluster {{.Cluster.Name}}.
+set -euo pipefail
+
+hostnamectl set-hostname "{{.Node.Name}}"
+echo "{{.Node.PrivateIP}} {{.Node.Name}}" >> /etc/hosts
+
+mkdir -p /etc/kubernetes
+cat > /etc/kubernetes/apps <<'EOF'
+{{- range $app, $version := .Kubernetes.Apps}}
+{{$app}}={{$version}}
+{{- end}}
+EOF
+
+apt-get update
+apt-get install -y curl docker.io ebtables ethtool socat conntrack
+systemctl enable --now docker
+
+# kubernetes-server {{index .Kubernetes.Apps "kubernetes-server"}}
+curl -fsSL "{{index .Kubernetes.Downloads "kubernetes-server"}}" | tar -xz -C /tmp
+install -m 0755 /tmp/kubernetes/server/bin/kubeadm /tmp/kubernetes/server/bin/kubelet /tmp/kubernetes/server/bin/kubectl /usr/bin/
+rm -rf /tmp/kubernetes
+{{- with index .Kubernetes.Downloads "hostfacts"}}
+
+# hostfacts {{index $.Kubernetes.Apps "hostfacts"}}
+curl -fsSL -o /usr/local/bin/hostfacts "{{.}}"
+chmod 0755 /usr/local/bin/hostfacts
+{{- end}}
+
+cat > /etc/systemd/system/kubelet.service <<'EOF'
+[Unit]
+Description=kubelet: The Kubernetes Node Agent
+After=docker.service
+Requires=docker.service
+
+[Service]
+ExecStart=/usr/bin/kubelet
+Restart=always
+StartLimitInterval=0
+RestartSec=10
+
+[Install]
+WantedBy=multi-user.target
+EOF
+mkdir -p /etc/systemd/system/kubelet.service.d
+cat > /etc/systemd/system/kubelet.service.d/10-kubeadm.conf <<'EOF'
+[Service]
+Environment="KUBELET_KUBECONFIG_ARGS=--kubeconfig=/etc/kubernetes/kubelet.conf --require-kubeconfig=true"
+Environment="KUBELET_SYSTEM_PODS_ARGS=--pod-manifest-path=/etc/kubernetes/manifests --allow-privileged=true"
+Environment="KUBELET_NETWORK_ARGS=--network-plugin=cni --cni-conf-dir=/etc/cni/net.d --cni-bin-dir=/opt/cni/bin"
+Environment="KUBELET_DNS_ARGS=--cluster-dns=10.96.0.10 --cluster-domain=cluster.local"
+Environment="KUBELET_AUTHZ_ARGS=--authorization-mode=Webhook --client-ca-file=/etc/kubernetes/pki/ca.crt"
+ExecStart=
+ExecStart=/usr/bin/kubelet $KUBELET_KUBECONFIG_ARGS $KUBELET_SYSTEM_PODS_ARGS $KUBELET_NETWORK_ARGS $KUBELET_DNS_ARGS $KUBELET_AUTHZ_ARGS $KUBELET_EXTRA_ARGS
+EOF
+systemctl daemon-reload
+systemctl enable --now kubelet
+
+if [ "{{.Node.Role}}" = "master" ]; then
+  kubeadm init --token "{{.Kubernetes.Token}}" \
+    --apiserver-advertise-address "{{.Node.PrivateIP}}" \
+    --kubernetes-version "v{{.Kubernetes.Version}}"
+else
+  # The master may still be coming up.
+  until kubeadm join --token "{{.Kubernetes.Token}}" "{{.Kubernetes.MasterIP}}:6443"; do
+    sleep 10
+  done
+fi
@@ -0,0 +1,14 @@
+#!/bin/bash
+{{/*
+This is a Go text/template. .Node.Name and the other .Node fields expand to variables that are
+filled in per node; udf "name" "label" "default" declares further inputs whose values come from
+script.udfs in the cluster spec.
+*/ -}}
+# Startup script of the nodes of cluster {{.Cluster.Name}}.
+set -euo pipefail
+
+hostnamectl set-hostname "{{.Node.Name}}"
+echo "{{.Node.PrivateIP}} {{.Node.Name}}" >> /etc/hosts
+
+apt-get update
+apt-get upgrade -y
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var secretsKeyFile = flag.String("secrets-key-file", "", "File with the 32 byte key that encrypts generated root passwords; created if missing. Without it, the passphrase in LINODE_SECRETS_PASSPHRASE is used")
+
+const (
+	passphraseEnv = "LINODE_SECRETS_PASSPHRASE"
+
+	KDFKeyFile = "key-file"
+	KDFPBKDF2  = "pbkdf2-sha256"
+
+	pbkdf2Iterations = 600000
+	secretKeySize    = 32 // AES-256
+
+	rootPasswordLength = 24
+)
+
+// SealedSecret is a secret encrypted with AES-GCM, as stored in the state file. The key is either
+// read from a key file or derived from a passphrase with PBKDF2, using Salt and Iterations.
+type SealedSecret struct {
+	KDF        string `json:"kdf"`
+	Salt       []byte `json:"salt,omitempty"`
+	Iterations int    `json:"iterations,omitempty"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// secretBox seals and opens secrets with the key material configured for this run.
+type secretBox struct {
+	kdf        string
+	key        []byte // for KDFKeyFile
+	passphrase string // for KDFPBKDF2
+}
+
+// newSecretBox uses -secrets-key-file if set, or else the passphrase in LINODE_SECRETS_PASSPHRASE.
+func newSecretBox() (*secretBox, error) {
+	if *secretsKeyFile != "" {
+		key, err := loadOrCreateSecretKey(*secretsKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &secretBox{kdf: KDFKeyFile, key: key}, nil
+	}
+	if pass := os.Getenv(passphraseEnv); pass != "" {
+		return &secretBox{kdf: KDFPBKDF2, passphrase: pass}, nil
+	}
+	return nil, fmt.Errorf("generated secrets are stored encrypted: set -secrets-key-file or %s", passphraseEnv)
+}
+
+// loadOrCreateSecretKey reads the key file, generating it if missing. A dry run only reads it.
+func loadOrCreateSecretKey(path string) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !*dryRun {
+		key = make([]byte, secretKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		if err := writeFileAtomic(path, key, 0600); err != nil {
+			return nil, err
+		}
+		fmt.Printf("Generated secrets key %s\n", path)
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != secretKeySize {
+		return nil, fmt.Errorf("secrets key file %s must hold exactly %d bytes, found %d", path, secretKeySize, len(key))
+	}
+	return key, nil
+}
+
+func (b *secretBox) aead(s *SealedSecret) (cipher.AEAD, error) {
+	if s.KDF != b.kdf {
+		return nil, fmt.Errorf("secret was sealed with %s, but %s is configured", s.KDF, b.kdf)
+	}
+	key := b.key
+	if s.KDF == KDFPBKDF2 {
+		key = pbkdf2.Key([]byte(b.passphrase), s.Salt, s.Iterations, secretKeySize, sha256.New)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts plaintext. context is authenticated along with it, so a secret can not be moved
+// to another record of the state file without Open noticing.
+func (b *secretBox) Seal(plaintext, context string) (*SealedSecret, error) {
+	s := &SealedSecret{KDF: b.kdf}
+	if b.kdf == KDFPBKDF2 {
+		s.Salt = make([]byte, 16)
+		if _, err := rand.Read(s.Salt); err != nil {
+			return nil, err
+		}
+		s.Iterations = pbkdf2Iterations
+	}
+	aead, err := b.aead(s)
+	if err != nil {
+		return nil, err
+	}
+	s.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(s.Nonce); err != nil {
+		return nil, err
+	}
+	s.Ciphertext = aead.Seal(nil, s.Nonce, []byte(plaintext), []byte(context))
+	return s, nil
+}
+
+func (b *secretBox) Open(s *SealedSecret, context string) (string, error) {
+	aead, err := b.aead(s)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := aead.Open(nil, s.Nonce, s.Ciphertext, []byte(context))
+	if err != nil {
+		return "", errors.New("can't decrypt secret: wrong key or passphrase, or the state was tampered with")
+	}
+	return string(plaintext), nil
+}
+
+// rootPasswordContext binds the root password of a node to its cluster and linode.
+func rootPasswordContext(linodeId int) string {
+	return spec.Name + "/" + strconv.Itoa(linodeId) + "/rootPassword"
+}
+
+var passwordClasses = []string{
+	"abcdefghijklmnopqrstuvwxyz",
+	"ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	"0123456789",
+	"!#%+,-.:=?@^_~",
+}
+
+// generatePassword returns a random root password that has a character of every class, which
+// satisfies Linode's rule of using at least two of lower case, upper case, digits and punctuation.
+// The punctuation avoids quotes, '$' and '\' so the password is safe to paste into a shell.
+func generatePassword() (string, error) {
+	var all string
+	for _, c := range passwordClasses {
+		all += c
+	}
+	pw := make([]byte, rootPasswordLength)
+	for i := range pw {
+		chars := all
+		if i < len(passwordClasses) {
+			chars = passwordClasses[i]
+		}
+		c, err := randomChar(chars)
+		if err != nil {
+			return "", err
+		}
+		pw[i] = c
+	}
+	// Move the guaranteed characters of each class to random positions.
+	for i := len(pw) - 1; i > 0; i-- {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return "", err
+		}
+		j := n.Int64()
+		pw[i], pw[j] = pw[j], pw[i]
+	}
+	return string(pw), nil
+}
+
+func randomChar(chars string) (byte, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+	if err != nil {
+		return 0, err
+	}
+	return chars[n.Int64()], nil
+}
+
+func cmdReveal(args []string) error {
+	fs := newFlagSet("reveal", "<node>")
+	if err := parseArgs(fs, args, 1); err != nil {
+		return err
+	}
+	st, err := openState(false)
+	if err != nil {
+		return err
+	}
+	name := fs.Arg(0)
+	id, _ := strconv.Atoi(name)
+	node := st.Find(name, id)
+	if node == nil {
+		return fmt.Errorf("node %q is not recorded in the state of cluster %s", name, spec.Name)
+	}
+	if node.RootPassword == nil {
+		return fmt.Errorf("no root password is recorded for node %s", node.Name)
+	}
+	box, err := newSecretBox()
+	if err != nil {
+		return err
+	}
+	pw, err := box.Open(node.RootPassword, rootPasswordContext(node.LinodeID))
+	if err != nil {
+		return err
+	}
+	fmt.Println(pw)
+	return nil
+}
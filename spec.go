@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const DefaultSwapDiskSize = 512 // MB
+
+// ClusterSpec describes a cluster and its node pools. It is loaded from a JSON file so that
+// every cluster can be reproduced from a checked-in file.
+type ClusterSpec struct {
+	Name       string `json:"name"`
+	Datacenter string `json:"datacenter"`
+	Plan       string `json:"plan"`
+	Distro     string `json:"distro"`
+	Kernel     string `json:"kernel,omitempty"`
+	Naming     string `json:"naming,omitempty"`
+	// Domain, if set, gives the public IP of every node the reverse DNS name <node>.<domain>.
+	Domain string `json:"domain,omitempty"`
+	// Kubernetes, if set, bootstraps a Kubernetes cluster on the nodes.
+	Kubernetes *KubernetesSpec `json:"kubernetes,omitempty"`
+	Script     ScriptSpec      `json:"script"`
+	Disks      DiskLayout      `json:"disks"`
+	// Roles override the plan, disks and script per node role; pools may override the disks again.
+	Roles     map[string]RoleSpec `json:"roles,omitempty"`
+	NodePools []NodePool          `json:"nodePools"`
+}
+
+// ScriptSpec selects the template the StackScript is rendered from. Dir is relative to the spec
+// file, and UDFs holds the values of the UDFs the template declares with the udf function.
+type ScriptSpec struct {
+	Name     string            `json:"name"`
+	Dir      string            `json:"dir,omitempty"`
+	Template string            `json:"template,omitempty"`
+	UDFs     map[string]string `json:"udfs,omitempty"`
+}
+
+// NodePool is a group of identical nodes. Disks, if set, overrides the disk layout of the pool's role.
+type NodePool struct {
+	Name  string      `json:"name"`
+	Count int         `json:"count"`
+	Role  string      `json:"role,omitempty"`
+	Disks *DiskLayout `json:"disks,omitempty"`
+}
+
+var labelRegexp = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]*$`)
+
+// poolNameRegexp keeps pool names usable in node labels and display groups.
+var poolNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9_-]*[a-zA-Z0-9])?$`)
+
+// maxClusterNameLength leaves room for the "-NNN-NNN-NNN-NNN" node suffix within Linode's 32
+// character label limit.
+const maxClusterNameLength = 16
+
+// FieldErrors collects validation errors keyed by the JSON path of the offending field.
+type FieldErrors []string
+
+func (e *FieldErrors) Add(field, format string, args ...interface{}) {
+	*e = append(*e, field+": "+fmt.Sprintf(format, args...))
+}
+
+func (e FieldErrors) Error() string {
+	return "invalid cluster spec:\n  " + strings.Join(e, "\n  ")
+}
+
+// LoadClusterSpec reads, defaults and validates the cluster spec stored in path.
+func LoadClusterSpec(path string) (*ClusterSpec, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// rootPassword was dropped so that no plaintext password is checked in; tell specs that still
+	// have it why they are rejected.
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(b, &fields) == nil {
+		if _, ok := fields["rootPassword"]; ok {
+			return nil, fmt.Errorf("cluster spec %s: rootPassword is not supported, every node gets a generated password, shown by reveal", path)
+		}
+	}
+	spec := &ClusterSpec{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(spec); err != nil {
+		return nil, fmt.Errorf("failed to parse cluster spec %s: %v", path, err)
+	}
+	spec.SetDefaults()
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(spec.Script.Dir) {
+		spec.Script.Dir = filepath.Join(filepath.Dir(path), spec.Script.Dir)
+	}
+	return spec, nil
+}
+
+func (s *ClusterSpec) SetDefaults() {
+	if s.Kernel == "" {
+		s.Kernel = KernelPolicyLatest
+	}
+	if s.Naming == "" {
+		s.Naming = NamingIP
+	}
+	if s.Script.Name == "" {
+		s.Script.Name = s.Name
+	}
+	if s.Script.Dir == "" {
+		s.Script.Dir = DefaultScriptDir
+	}
+	if s.Kubernetes != nil {
+		if s.Kubernetes.Env == "" {
+			s.Kubernetes.Env = DefaultKubernetesEnv
+		}
+		if s.Script.Template == "" {
+			s.Script.Template = DefaultKubernetesTemplate
+		}
+		for i := range s.NodePools {
+			if s.NodePools[i].Role == "" {
+				s.NodePools[i].Role = RoleWorker
+			}
+		}
+	}
+	if s.Script.Template == "" {
+		s.Script.Template = DefaultScriptTemplate
+	}
+	s.Disks.setDefaults()
+	for _, r := range s.Roles {
+		if r.Disks != nil {
+			r.Disks.setDefaults()
+		}
+	}
+	for _, p := range s.NodePools {
+		if p.Disks != nil {
+			p.Disks.setDefaults()
+		}
+	}
+}
+
+func (s *ClusterSpec) Validate() error {
+	var errs FieldErrors
+
+	switch {
+	case s.Name == "":
+		errs.Add("name", "is required")
+	case len(s.Name) > maxClusterNameLength:
+		errs.Add("name", "must be at most %d characters", maxClusterNameLength)
+	case !labelRegexp.MatchString(s.Name):
+		errs.Add("name", "must start with a letter and contain only letters, digits, '-' and '_'")
+	}
+	if err := validateDatacenterSelector(s.Datacenter); err != nil {
+		errs.Add("datacenter", "%v", err)
+	}
+	if err := validatePlanSelector(s.Plan); err != nil {
+		errs.Add("plan", "%v", err)
+	}
+	if _, err := parseDistroSelector(s.Distro); err != nil {
+		errs.Add("distro", "%v", err)
+	}
+	if _, err := parseKernelPolicy(s.Kernel); err != nil {
+		errs.Add("kernel", "%v", err)
+	}
+	strategy, err := namingStrategy(s.Naming)
+	if err != nil {
+		errs.Add("naming", "%v", err)
+	}
+	if s.Domain != "" && !domainRegexp.MatchString(s.Domain) {
+		errs.Add("domain", "must be a lower case DNS domain such as example.com, got %q", s.Domain)
+	}
+	if s.Script.Name == "" {
+		errs.Add("script.name", "is required")
+	}
+	validateUDFValues(&errs, "script.udfs", s.Script.UDFs)
+	validateDiskLayout(&errs, "disks", &s.Disks)
+
+	if len(s.NodePools) == 0 {
+		errs.Add("nodePools", "at least one node pool is required")
+	}
+	names := map[string]bool{}
+	for i, p := range s.NodePools {
+		field := fmt.Sprintf("nodePools[%d]", i)
+		switch {
+		case p.Name == "":
+			errs.Add(field+".name", "is required")
+		case names[p.Name]:
+			errs.Add(field+".name", "duplicate pool name %q", p.Name)
+		case !poolNameRegexp.MatchString(p.Name):
+			errs.Add(field+".name", "must contain only letters, digits, '-' and '_' and start and end with a letter or digit, got %q", p.Name)
+		case strategy != nil && labelRegexp.MatchString(s.Name):
+			if err := validateCandidate(strategy, s.Name, p.Name); err != nil {
+				errs.Add(field+".name", "%v", err)
+			}
+		}
+		names[p.Name] = true
+		if p.Count < 0 {
+			errs.Add(field+".count", "must not be negative")
+		}
+		if p.Disks != nil {
+			validateDiskLayout(&errs, field+".disks", p.Disks)
+		}
+	}
+	s.validateRoles(&errs)
+	if s.Kubernetes != nil {
+		s.validateKubernetes(&errs)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateCandidate checks that the longest label the naming strategy can give a node of pool is a
+// valid Linode label.
+func validateCandidate(strategy NamingStrategy, cluster, pool string) error {
+	name, err := longestCandidate(strategy, cluster, pool)
+	if err != nil {
+		return err
+	}
+	if err := validateLabel(name); err != nil {
+		return fmt.Errorf("gives its nodes invalid names: %v", err)
+	}
+	return nil
+}
+
+func validateUDFValues(errs *FieldErrors, field string, udfs map[string]string) {
+	names := make([]string, 0, len(udfs))
+	for name := range udfs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch {
+		case !udfNameRegexp.MatchString(name):
+			errs.Add(field, "invalid UDF name %q", name)
+		case containsString(toolUDFs, name):
+			errs.Add(field, "UDF %q is set per node and can't be given a value", name)
+		}
+	}
+}
+
+// validateKubernetes checks the Kubernetes bootstrap. kubeadm sets up a single master, so exactly
+// one pool has the master role, with one node. Nodes of the other roles join it.
+func (s *ClusterSpec) validateKubernetes(errs *FieldErrors) {
+	if s.Kubernetes.Version == "" {
+		errs.Add("kubernetes.version", "is required")
+	}
+	masters := 0
+	for i, p := range s.NodePools {
+		if p.Role != RoleMaster {
+			continue
+		}
+		masters++
+		if p.Count != 1 {
+			errs.Add(fmt.Sprintf("nodePools[%d].count", i), "the master pool must have exactly one node")
+		}
+	}
+	if masters != 1 {
+		errs.Add("nodePools", "exactly one pool must have role %s, found %d", RoleMaster, masters)
+	}
+}
+
+// NodePool returns the pool with the given name. An empty name selects the first pool.
+func (s *ClusterSpec) NodePool(name string) (*NodePool, error) {
+	if name == "" {
+		return &s.NodePools[0], nil
+	}
+	for i := range s.NodePools {
+		if s.NodePools[i].Name == name {
+			return &s.NodePools[i], nil
+		}
+	}
+	return nil, fmt.Errorf("node pool %q: %v", name, ErrNotFound)
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	sshKeyType     = "ssh-ed25519"
+	sshKeyFileName = "id_ed25519"
+	sshKeyMagic    = "openssh-key-v1\x00"
+)
+
+// SSHKey is the ed25519 keypair used to log into every node of a cluster as root.
+type SSHKey struct {
+	PrivateKey ed25519.PrivateKey
+	Comment    string
+}
+
+func generateSSHKey(comment string) (*SSHKey, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &SSHKey{PrivateKey: priv, Comment: comment}, nil
+}
+
+func (k *SSHKey) PublicKey() ed25519.PublicKey {
+	return k.PrivateKey.Public().(ed25519.PublicKey)
+}
+
+// publicBlob returns the public key in SSH wire format.
+func (k *SSHKey) publicBlob() []byte {
+	return append(sshString([]byte(sshKeyType)), sshString(k.PublicKey())...)
+}
+
+// AuthorizedKey returns the public key as a line of an authorized_keys file.
+func (k *SSHKey) AuthorizedKey() string {
+	return sshKeyType + " " + base64.StdEncoding.EncodeToString(k.publicBlob()) + " " + k.Comment
+}
+
+// MarshalOpenSSH encodes the unencrypted private key in the format written by ssh-keygen, so the
+// key file can be used with ssh -i directly.
+func (k *SSHKey) MarshalOpenSSH() []byte {
+	check := make([]byte, 4)
+	rand.Read(check)
+	var priv []byte
+	priv = append(priv, check...)
+	priv = append(priv, check...)
+	priv = append(priv, sshString([]byte(sshKeyType))...)
+	priv = append(priv, sshString(k.PublicKey())...)
+	priv = append(priv, sshString(k.PrivateKey)...)
+	priv = append(priv, sshString([]byte(k.Comment))...)
+	for i := byte(1); len(priv)%8 != 0; i++ {
+		priv = append(priv, i)
+	}
+
+	var b []byte
+	b = append(b, sshKeyMagic...)
+	b = append(b, sshString([]byte("none"))...)
+	b = append(b, sshString([]byte("none"))...)
+	b = append(b, sshString(nil)...)
+	b = append(b, 0, 0, 0, 1)
+	b = append(b, sshString(k.publicBlob())...)
+	b = append(b, sshString(priv)...)
+	return pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: b})
+}
+
+// parseOpenSSHKey decodes an unencrypted ed25519 key written by MarshalOpenSSH or ssh-keygen.
+func parseOpenSSHKey(data []byte) (*SSHKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "OPENSSH PRIVATE KEY" {
+		return nil, errors.New("not an OpenSSH private key")
+	}
+	b := block.Bytes
+	if !bytes.HasPrefix(b, []byte(sshKeyMagic)) {
+		return nil, errors.New("not an OpenSSH private key")
+	}
+	b = b[len(sshKeyMagic):]
+
+	var cipher, kdf, priv []byte
+	var ok bool
+	if cipher, b, ok = readSSHString(b); !ok {
+		return nil, errors.New("truncated private key")
+	}
+	if kdf, b, ok = readSSHString(b); !ok {
+		return nil, errors.New("truncated private key")
+	}
+	if string(cipher) != "none" || string(kdf) != "none" {
+		return nil, errors.New("encrypted private keys are not supported")
+	}
+	if _, b, ok = readSSHString(b); !ok || len(b) < 4 {
+		return nil, errors.New("truncated private key")
+	}
+	if n := binary.BigEndian.Uint32(b); n != 1 {
+		return nil, fmt.Errorf("expected 1 key, found %d", n)
+	}
+	if _, b, ok = readSSHString(b[4:]); !ok {
+		return nil, errors.New("truncated private key")
+	}
+	if priv, _, ok = readSSHString(b); !ok || len(priv) < 8 {
+		return nil, errors.New("truncated private key")
+	}
+	if !bytes.Equal(priv[0:4], priv[4:8]) {
+		return nil, errors.New("corrupt private key")
+	}
+
+	fields := make([][]byte, 4)
+	rest := priv[8:]
+	for i := range fields {
+		if fields[i], rest, ok = readSSHString(rest); !ok {
+			return nil, errors.New("truncated private key")
+		}
+	}
+	if string(fields[0]) != sshKeyType {
+		return nil, fmt.Errorf("unsupported key type %s, only %s keys are supported", fields[0], sshKeyType)
+	}
+	if len(fields[2]) != ed25519.PrivateKeySize {
+		return nil, errors.New("corrupt private key")
+	}
+	return &SSHKey{PrivateKey: ed25519.PrivateKey(fields[2]), Comment: string(fields[3])}, nil
+}
+
+func sshString(s []byte) []byte {
+	b := make([]byte, 4, 4+len(s))
+	binary.BigEndian.PutUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func readSSHString(b []byte) (s, rest []byte, ok bool) {
+	if len(b) < 4 {
+		return nil, nil, false
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint64(len(b)-4) < uint64(n) {
+		return nil, nil, false
+	}
+	return b[4 : 4+n], b[4+n:], true
+}
+
+// sshKeyPath is where the private key of a cluster is kept, next to its state. The public key is
+// written to the same path with a .pub suffix.
+func sshKeyPath(cluster string) string {
+	return filepath.Join(clusterStateDir(cluster), sshKeyFileName)
+}
+
+func loadSSHKey(path string) (*SSHKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	k, err := parseOpenSSHKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load SSH key %s: %v", path, err)
+	}
+	return k, nil
+}
+
+func writeSSHKey(path string, k *SSHKey) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, k.MarshalOpenSSH(), 0600); err != nil {
+		return err
+	}
+	return writeFileAtomic(path+".pub", []byte(k.AuthorizedKey()+"\n"), 0644)
+}
+
+// loadOrCreateSSHKey returns the SSH key of the cluster in spec, generating it on first use. In a
+// dry run a new key is not written to disk.
+func loadOrCreateSSHKey() (*SSHKey, error) {
+	path := sshKeyPath(spec.Name)
+	k, err := loadSSHKey(path)
+	if !os.IsNotExist(err) {
+		return k, err
+	}
+	k, err = generateSSHKey("root@" + spec.Name)
+	if err != nil {
+		return nil, err
+	}
+	if *dryRun {
+		return k, nil
+	}
+	if err := writeSSHKey(path, k); err != nil {
+		return nil, err
+	}
+	fmt.Printf("Generated SSH key %s\n", path)
+	return k, nil
+}
+
+func cmdSSHKey(args []string) error {
+	if len(args) == 0 || (args[0] != "show" && args[0] != "rotate") {
+		fmt.Fprintf(os.Stderr, "Usage: %s ssh-key show|rotate\n", os.Args[0])
+		return errUsage
+	}
+	fs := newFlagSet("ssh-key "+args[0], "")
+	if err := parseArgs(fs, args[1:], 0); err != nil {
+		return err
+	}
+	if args[0] == "rotate" {
+		return rotateSSHKey()
+	}
+
+	path := sshKeyPath(spec.Name)
+	k, err := loadSSHKey(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("cluster %s has no SSH key yet, it is generated when the first node is created", spec.Name)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Private key: %s\n%s\n", path, k.AuthorizedKey())
+	return nil
+}
+
+// rotateSSHKey replaces the SSH key of the cluster on every node recorded in the state. The new key
+// is authorized on all nodes before the old one is revoked anywhere, so a failed rotation never
+// locks us out: the pending key is kept in <key>.new and the rotation can simply be run again.
+func rotateSSHKey() error {
+	st, err := openState(true)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	path := sshKeyPath(spec.Name)
+	oldKey, err := loadSSHKey(path)
+	if err != nil {
+		return err
+	}
+	newPath := path + ".new"
+	newKey, err := loadSSHKey(newPath)
+	if os.IsNotExist(err) {
+		newKey, err = generateSSHKey("root@" + spec.Name)
+		if err == nil && !*dryRun {
+			err = writeSSHKey(newPath, newKey)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	nodes := st.Nodes()
+	var failed []string
+	for _, n := range nodes {
+		err := runSSH(path, n, authorizeKeyScript(newKey))
+		if err == nil {
+			err = runSSH(newPath, n, "true")
+		}
+		if err != nil {
+			fmt.Printf("%s: failed to authorize new key: %v\n", n.Name, err)
+			failed = append(failed, n.Name)
+			continue
+		}
+		fmt.Printf("%s: new key authorized\n", n.Name)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("new key could not be authorized on %s; the old key is still valid everywhere and the new one is kept in %s, run rotate again to retry",
+			strings.Join(failed, ", "), newPath)
+	}
+
+	if !*dryRun {
+		if err := writeSSHKey(path, newKey); err != nil {
+			return err
+		}
+		os.Remove(newPath)
+		os.Remove(newPath + ".pub")
+	}
+	for _, n := range nodes {
+		if err := runSSH(path, n, revokeKeyScript(oldKey)); err != nil {
+			fmt.Printf("%s: failed to revoke old key: %v\n", n.Name, err)
+			failed = append(failed, n.Name)
+			continue
+		}
+		fmt.Printf("%s: old key revoked\n", n.Name)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("rotated to the new key, but the old key is still authorized on %s", strings.Join(failed, ", "))
+	}
+	fmt.Printf("Rotated SSH key of %d nodes\n%s\n", len(nodes), newKey.AuthorizedKey())
+	return nil
+}
+
+func authorizeKeyScript(k *SSHKey) string {
+	line := k.AuthorizedKey()
+	return fmt.Sprintf("mkdir -p ~/.ssh && chmod 700 ~/.ssh && (grep -qxF '%s' ~/.ssh/authorized_keys 2>/dev/null || echo '%s' >> ~/.ssh/authorized_keys)", line, line)
+}
+
+// revokeKeyScript removes the key by its base64 blob, so it also matches lines with another comment.
+func revokeKeyScript(k *SSHKey) string {
+	blob := base64.StdEncoding.EncodeToString(k.publicBlob())
+	return fmt.Sprintf("grep -vF '%s' ~/.ssh/authorized_keys > ~/.ssh/authorized_keys.tmp; mv ~/.ssh/authorized_keys.tmp ~/.ssh/authorized_keys", blob)
+}
+
+// runSSH runs a shell command as root on node using the system ssh client. Host keys are pinned
+// in a known_hosts file kept with the cluster state.
+func runSSH(keyPath string, node *NodeRecord, command string) error {
+	if *dryRun {
+		fmt.Printf("would run on %s: %s\n", node.Name, command)
+		return nil
+	}
+	cmd := exec.Command("ssh",
+		"-i", keyPath,
+		"-o", "IdentitiesOnly=yes",
+		"-o", "BatchMode=yes",
+		"-o", "ConnectTimeout=10",
+		"-o", "StrictHostKeyChecking=accept-new",
+		"-o", "UserKnownHostsFile="+filepath.Join(clusterStateDir(spec.Name), "known_hosts"),
+		"root@"+node.PublicIP,
+		command)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
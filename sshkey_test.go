@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"strings"
+	"testing"
+)
+
+func TestOpenSSHKeyRoundTrip(t *testing.T) {
+	key, err := generateSSHKey("root@c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseOpenSSHKey(key.MarshalOpenSSH())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.AuthorizedKey() != key.AuthorizedKey() {
+		t.Errorf("parsed key has authorized key %q, want %q", parsed.AuthorizedKey(), key.AuthorizedKey())
+	}
+	if !bytes.Equal(parsed.PrivateKey, key.PrivateKey) {
+		t.Error("parsed private key differs from the marshaled one")
+	}
+}
+
+func TestParseOpenSSHKeyTruncated(t *testing.T) {
+	key, err := generateSSHKey("root@c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(key.MarshalOpenSSH())
+	for n := 0; n < len(block.Bytes); n++ {
+		truncated := pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: block.Bytes[:n]})
+		if _, err := parseOpenSSHKey(truncated); err == nil {
+			t.Errorf("parseOpenSSHKey accepted a key truncated to %d of %d bytes", n, len(block.Bytes))
+		}
+	}
+}
+
+func TestParseOpenSSHKeyEncrypted(t *testing.T) {
+	var b []byte
+	b = append(b, sshKeyMagic...)
+	b = append(b, sshString([]byte("aes256-ctr"))...)
+	b = append(b, sshString([]byte("bcrypt"))...)
+	b = append(b, sshString(make([]byte, 24))...)
+	b = append(b, 0, 0, 0, 1)
+	data := pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: b})
+	_, err := parseOpenSSHKey(data)
+	if err == nil || !strings.Contains(err.Error(), "encrypted") {
+		t.Errorf("parseOpenSSHKey(encrypted key) = %v, want an error about encryption", err)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/taoh/linodego"
+)
+
+const (
+	DefaultScriptDir      = "scripts"
+	DefaultScriptTemplate = "node.sh"
+)
+
+// StackScript is a script rendered from a template, ready to be uploaded. Role is set if the
+// template belongs to a role.
+type StackScript struct {
+	Label string
+	Role  string
+	Body  string
+	UDFs  []UDF
+}
+
+// UDFResponses are the values of the UDFs of a StackScript for one node, keyed by UDF name.
+type UDFResponses map[string]string
+
+// JSON encodes the responses in the form expected by Disk.CreateFromStackscript. Values are sent
+// as they are, without escaping HTML characters.
+func (r UDFResponses) JSON() (string, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(r); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// Redacted returns a copy of the responses with the values of secret UDFs replaced, for printing
+// and logging.
+func (r UDFResponses) Redacted() UDFResponses {
+	c := make(UDFResponses, len(r))
+	for k, v := range r {
+		if isSecretUDF(k) {
+			v = "<redacted>"
+		}
+		c[k] = v
+	}
+	return c
+}
+
+// isSecretUDF reports whether the value of a UDF must not be shown: the kubeadm join token and
+// password fields.
+func isSecretUDF(name string) bool {
+	return name == UDFJoinToken || UDF{Name: name}.Type() == UDFTypePassword
+}
+
+// UDFs whose values are filled in per node by the tool itself.
+const (
+	UDFHostname  = "hostname"
+	UDFPrivateIP = "private_ip"
+	UDFPublicIP  = "public_ip"
+	UDFPool      = "pool"
+	UDFRole      = "role"
+	UDFMasterIP  = "master_ip"
+	UDFJoinToken = "join_token"
+)
+
+var toolUDFs = []string{UDFHostname, UDFPrivateIP, UDFPublicIP, UDFPool, UDFRole, UDFMasterIP, UDFJoinToken}
+
+var udfNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// ScriptData is what a StackScript template is executed with. A StackScript is shared by every node
+// of the cluster, so the fields of Node do not hold values: they expand to the variable of a UDF
+// that is declared on first use and filled in when a node is created. Kubernetes is nil unless
+// the spec bootstraps Kubernetes.
+type ScriptData struct {
+	Cluster    ClusterData
+	Kubernetes *kubernetesVars
+	Node       *nodeVars
+}
+
+type ClusterData struct {
+	Name       string
+	Datacenter string
+	Plan       string
+}
+
+type nodeVars struct {
+	r *scriptRenderer
+}
+
+func (n *nodeVars) Name() string {
+	return n.r.declare(UDF{Name: UDFHostname, Label: "Node hostname"})
+}
+
+func (n *nodeVars) PrivateIP() string {
+	return n.r.declare(UDF{Name: UDFPrivateIP, Label: "Private IP of the node"})
+}
+
+func (n *nodeVars) PublicIP() string {
+	return n.r.declare(UDF{Name: UDFPublicIP, Label: "Public IP of the node"})
+}
+
+func (n *nodeVars) Pool() string {
+	return n.r.declare(UDF{Name: UDFPool, Label: "Node pool"})
+}
+
+// Role is optional, since pools need not have one.
+func (n *nodeVars) Role() string {
+	return n.r.declare(UDF{Name: UDFRole, Label: "Role of the node", HasDefault: true})
+}
+
+// kubernetesVars holds the catalog entry of the Kubernetes version and the download URLs of its
+// apps. MasterIP and Token are UDFs like the fields of nodeVars.
+type kubernetesVars struct {
+	Version   string
+	Apps      map[string]string
+	Downloads map[string]string
+	r         *scriptRenderer
+}
+
+func (k *kubernetesVars) MasterIP() string {
+	return k.r.declare(UDF{Name: UDFMasterIP, Label: "Private IP of the Kubernetes master"})
+}
+
+func (k *kubernetesVars) Token() string {
+	return k.r.declare(UDF{Name: UDFJoinToken, Label: "kubeadm token"})
+}
+
+// scriptRenderer collects the UDFs declared while a template is executed.
+type scriptRenderer struct {
+	udfs []UDF
+	err  error
+}
+
+// declare registers a UDF, unless it already was, and returns the shell variable holding its value.
+func (r *scriptRenderer) declare(u UDF) string {
+	if !udfNameRegexp.MatchString(u.Name) {
+		r.err = fmt.Errorf("invalid UDF name %q", u.Name)
+		return ""
+	}
+	if err := u.tagError(); err != nil {
+		r.err = err
+		return ""
+	}
+	for _, d := range r.udfs {
+		if d.Name == u.Name {
+			return "${" + u.Name + "}"
+		}
+	}
+	r.udfs = append(r.udfs, u)
+	return "${" + u.Name + "}"
+}
+
+// templatePath returns the path of the template name within the script directory of the spec.
+func templatePath(name string) string {
+	return filepath.Join(spec.Script.Dir, name)
+}
+
+// renderStackScript executes the template of the script of cfg from the script directory of the
+// spec. Templates declare extra UDFs with {{udf "name" "label" "default"}}, or {{udfOneOf "name"
+// "label" "a,b" "default"}} for a choice, which expand to the UDF's variable; the default is
+// optional. The UDF tags are inserted right after the #! line of the result. Templates may also
+// contain UDF tags of their own.
+func renderStackScript(cfg NodeConfig) (*StackScript, error) {
+	r := &scriptRenderer{}
+	funcs := template.FuncMap{
+		"udf": func(name, label string, def ...string) string {
+			return r.declare(UDF{Name: name, Label: label, Default: strings.Join(def, ""), HasDefault: len(def) > 0})
+		},
+		"udfOneOf": func(name, label, values string, def ...string) string {
+			return r.declare(UDF{Name: name, Label: label, OneOf: strings.Split(values, ","), Default: strings.Join(def, ""), HasDefault: len(def) > 0})
+		},
+	}
+	path := templatePath(cfg.Script.Template)
+	t, err := template.New(filepath.Base(path)).Funcs(funcs).Option("missingkey=error").ParseFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	// A script shared by several roles is rendered with the cluster wide plan.
+	plan := spec.Plan
+	if cfg.Script.Name != spec.Script.Name {
+		plan = cfg.Plan
+	}
+	data := ScriptData{
+		Cluster: ClusterData{
+			Name:       spec.Name,
+			Datacenter: spec.Datacenter,
+			Plan:       plan,
+		},
+		Node: &nodeVars{r: r},
+	}
+	if spec.Kubernetes != nil {
+		v, err := resolveKubernetesVersion()
+		if err != nil {
+			return nil, err
+		}
+		data.Kubernetes = &kubernetesVars{Version: v.Version, Apps: v.Apps, Downloads: appDownloads(v), r: r}
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("%s: %v", path, r.err)
+	}
+
+	body := buf.String()
+	if !strings.HasPrefix(body, "#!") {
+		return nil, fmt.Errorf("%s: a StackScript must start with a #! line", path)
+	}
+	shebang, rest := body, ""
+	if i := strings.Index(body, "\n"); i >= 0 {
+		shebang, rest = body[:i+1], body[i+1:]
+	}
+	var tags []string
+	for _, u := range r.udfs {
+		tags = append(tags, u.Tag())
+	}
+	if len(tags) > 0 {
+		body = shebang + strings.Join(tags, "\n") + "\n" + rest
+	}
+	udfs, err := parseUDFs(body)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	script := &StackScript{Label: cfg.Script.Name, Body: body, UDFs: udfs}
+	if cfg.Script.Name != spec.Script.Name {
+		script.Role = cfg.Role
+	}
+	return script, nil
+}
+
+// JoinInfo is what a node needs to join the Kubernetes cluster.
+type JoinInfo struct {
+	MasterIP string
+	Token    string
+}
+
+// UDFResponses fills in the UDFs of the script for node. Per node UDFs get their values from the
+// node and join, all others from the script udfs of the pool's role; UDFs without a value are left
+// to their default. Spec udfs the script does not declare are passed on as well, for
+// validateUDFResponses to reject. join is nil unless the spec bootstraps Kubernetes.
+func (s *StackScript) UDFResponses(node *NodeRecord, pool *NodePool, join *JoinInfo) UDFResponses {
+	values := map[string]string{
+		UDFHostname:  node.Name,
+		UDFPrivateIP: node.PrivateIP,
+		UDFPublicIP:  node.PublicIP,
+		UDFPool:      pool.Name,
+		UDFRole:      pool.Role,
+	}
+	if join != nil {
+		values[UDFMasterIP] = join.MasterIP
+		values[UDFJoinToken] = join.Token
+	}
+	r := UDFResponses{}
+	for name, v := range spec.NodeConfig(pool.Role).Script.UDFs {
+		if v != "" {
+			r[name] = v
+		}
+	}
+	for _, u := range s.UDFs {
+		if v, ok := values[u.Name]; ok {
+			delete(r, u.Name)
+			if v != "" {
+				r[u.Name] = v
+			}
+		}
+	}
+	return r
+}
+
+// findStackScript returns the StackScript of the account with the given label, or nil.
+func findStackScript(label string) (*linodego.StackScript, error) {
+	resp, err := client.StackScript.List(0)
+	if err != nil {
+		return nil, err
+	}
+	for i, s := range resp.StackScripts {
+		if s.Label.String() == label {
+			return &resp.StackScripts[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// normalizeScript undoes the differences Linode may introduce when it stores a script, line
+// endings and trailing newlines, so they are not mistaken for changes.
+func normalizeScript(body string) string {
+	return strings.TrimRight(strings.Replace(body, "\r\n", "\n", -1), "\n") + "\n"
+}
+
+// scriptHash is the SHA-256 of the normalized script, used to tell whether the uploaded script is
+// out of date.
+func scriptHash(body string) string {
+	sum := sha256.Sum256([]byte(normalizeScript(body)))
+	return hex.EncodeToString(sum[:])
+}
+
+// revNote describes the update of the StackScript old to script for its revision history.
+func revNote(old *linodego.StackScript, script *StackScript, distributionId int) string {
+	var changes []string
+	if scriptHash(old.Script) != scriptHash(script.Body) {
+		added, removed := diffStats(normalizeScript(old.Script), normalizeScript(script.Body))
+		changes = append(changes, fmt.Sprintf("script %s -> %s (+%d -%d lines)",
+			scriptHash(old.Script)[:12], scriptHash(script.Body)[:12], added, removed))
+	}
+	if !containsString(splitIDList(customString(&old.DistributionidList)), strconv.Itoa(distributionId)) {
+		changes = append(changes, fmt.Sprintf("added distribution %d", distributionId))
+	}
+	return strings.Join(changes, "; ")
+}
+
+// splitIDList splits a comma separated list of IDs as used by the API, e.g. DistributionIDList.
+func splitIDList(s string) []string {
+	var ids []string
+	for _, id := range strings.Split(s, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
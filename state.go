@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// StateVersion is the version of the state file format written by this tool.
+const StateVersion = 1
+
+var stateDir = flag.String("state-dir", ".linode-demo", "Directory holding the local state of each cluster")
+
+// ClusterState is the local inventory of the nodes provisioned for a cluster. JoinToken is the
+// kubeadm token of a Kubernetes cluster.
+type ClusterState struct {
+	Version   int           `json:"version"`
+	Cluster   string        `json:"cluster"`
+	Nodes     []*NodeRecord `json:"nodes"`
+	JoinToken *SealedSecret `json:"joinToken,omitempty"`
+}
+
+// NodeRecord is everything known about a provisioned node, including the IDs of the Linode
+// objects created for it. RootPassword is the sealed, generated root password of the node.
+type NodeRecord struct {
+	NodeInfo
+	Pool         string        `json:"pool,omitempty"`
+	LinodeID     int           `json:"linodeID"`
+	ConfigID     int           `json:"configID,omitempty"`
+	SwapDiskID   int           `json:"swapDiskID,omitempty"`
+	DataDiskIDs  []int         `json:"dataDiskIDs,omitempty"`
+	JobIDs       []int         `json:"jobIDs,omitempty"`
+	CreatedAt    time.Time     `json:"createdAt,omitempty"`
+	RootPassword *SealedSecret `json:"rootPassword,omitempty"`
+}
+
+// stateStore gives access to the state file of one cluster. A store opened for writing holds an
+// exclusive lock on the state until Close is called or the process exits.
+type stateStore struct {
+	dir      string
+	writable bool
+	dryRun   bool
+	lockFile *os.File
+
+	mu    sync.Mutex
+	state *ClusterState
+}
+
+func clusterStateDir(cluster string) string {
+	return filepath.Join(*stateDir, cluster)
+}
+
+// openState loads the state of the cluster in spec. If writable is set, the state is locked so
+// that concurrent runs can not overwrite each other's changes. A dry run writes nothing, not even
+// the state directory or the lock file, and keeps changes in memory only.
+func openState(writable bool) (*stateStore, error) {
+	s := &stateStore{
+		dir:      clusterStateDir(spec.Name),
+		writable: writable,
+		dryRun:   *dryRun,
+	}
+	if writable && !s.dryRun {
+		if err := os.MkdirAll(s.dir, 0700); err != nil {
+			return nil, err
+		}
+		if err := s.lock(); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.load(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *stateStore) path() string {
+	return filepath.Join(s.dir, "state.json")
+}
+
+func (s *stateStore) lockPath() string {
+	return filepath.Join(s.dir, "state.lock")
+}
+
+// lock takes an flock on the lock file. The kernel releases it when the process exits, even after
+// Ctrl-C or a crash, so a lock file left behind doesn't block the next run. The owner is written
+// to the file for the message of a run that finds the state locked.
+func (s *stateStore) lock() error {
+	f, err := os.OpenFile(s.lockPath(), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			owner, _ := ioutil.ReadFile(s.lockPath())
+			return fmt.Errorf("state of cluster %s is locked by %s", spec.Name, owner)
+		}
+		return fmt.Errorf("failed to lock %s: %v", s.lockPath(), err)
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "pid %d since %s", os.Getpid(), time.Now().Format(time.RFC3339)); err != nil {
+		f.Close()
+		return err
+	}
+	s.lockFile = f
+	return nil
+}
+
+// Close releases the lock held by a writable store. The lock file stays, removing it would let
+// a run that already opened it lock a file nobody else sees.
+func (s *stateStore) Close() error {
+	if s.lockFile == nil {
+		return nil
+	}
+	err := s.lockFile.Close()
+	s.lockFile = nil
+	return err
+}
+
+func (s *stateStore) load() error {
+	b, err := ioutil.ReadFile(s.path())
+	if os.IsNotExist(err) {
+		s.state = &ClusterState{Version: StateVersion, Cluster: spec.Name}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	state := &ClusterState{}
+	if err := json.Unmarshal(b, state); err != nil {
+		return fmt.Errorf("failed to parse state file %s: %v", s.path(), err)
+	}
+	switch {
+	case state.Version == 0:
+		return fmt.Errorf("state file %s has no version", s.path())
+	case state.Version > StateVersion:
+		return fmt.Errorf("state file %s has version %d, this tool only understands up to version %d", s.path(), state.Version, StateVersion)
+	case state.Cluster != spec.Name:
+		return fmt.Errorf("state file %s belongs to cluster %s, not %s", s.path(), state.Cluster, spec.Name)
+	}
+	s.state = state
+	return nil
+}
+
+// save atomically replaces the state file. The caller must hold s.mu.
+func (s *stateStore) save() error {
+	if !s.writable {
+		return fmt.Errorf("state of cluster %s was opened read-only", spec.Name)
+	}
+	if s.dryRun {
+		return nil
+	}
+	sort.Slice(s.state.Nodes, func(i, j int) bool {
+		return s.state.Nodes[i].LinodeID < s.state.Nodes[j].LinodeID
+	})
+	b, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(), b, 0600)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it over path, so
+// readers never see a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, perm); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Nodes returns a snapshot of the recorded nodes.
+func (s *stateStore) Nodes() []*NodeRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	nodes := make([]*NodeRecord, len(s.state.Nodes))
+	copy(nodes, s.state.Nodes)
+	return nodes
+}
+
+// Find returns the node with the given name or Linode ID, or nil if it is not recorded.
+func (s *stateStore) Find(name string, linodeId int) *NodeRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, n := range s.state.Nodes {
+		if (name != "" && n.Name == name) || (linodeId > 0 && n.LinodeID == linodeId) {
+			return n
+		}
+	}
+	return nil
+}
+
+// Put adds or replaces the record of a node and saves the state.
+func (s *stateStore) Put(node *NodeRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, n := range s.state.Nodes {
+		if n.LinodeID == node.LinodeID {
+			s.state.Nodes[i] = node
+			return s.save()
+		}
+	}
+	s.state.Nodes = append(s.state.Nodes, node)
+	return s.save()
+}
+
+// Remove drops the record of a node, if any, and saves the state.
+func (s *stateStore) Remove(linodeId int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, n := range s.state.Nodes {
+		if n.LinodeID == linodeId {
+			s.state.Nodes = append(s.state.Nodes[:i], s.state.Nodes[i+1:]...)
+			return s.save()
+		}
+	}
+	return nil
+}
+
+func (s *stateStore) JoinToken() *SealedSecret {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.JoinToken
+}
+
+// SetJoinToken records the kubeadm token of the cluster and saves the state.
+func (s *stateStore) SetJoinToken(token *SealedSecret) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.JoinToken = token
+	return s.save()
+}
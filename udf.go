@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// UDF is a user defined field of a StackScript. Linode asks for its value when a disk is created
+// from the script and passes it to the script as an environment variable of the same name. A UDF
+// without a default is required; OneOf and ManyOf restrict its value to one or a comma separated
+// subset of the listed values.
+type UDF struct {
+	Name       string
+	Label      string
+	Default    string
+	HasDefault bool
+	Example    string
+	OneOf      []string
+	ManyOf     []string
+}
+
+// UDF types, as shown by the Linode manager.
+const (
+	UDFTypeText        = "text"
+	UDFTypePassword    = "password"
+	UDFTypeSelect      = "select"
+	UDFTypeMultiSelect = "multiselect"
+)
+
+func (u UDF) Type() string {
+	switch {
+	case len(u.OneOf) > 0:
+		return UDFTypeSelect
+	case len(u.ManyOf) > 0:
+		return UDFTypeMultiSelect
+	case strings.Contains(strings.ToLower(u.Name), "password"):
+		return UDFTypePassword
+	}
+	return UDFTypeText
+}
+
+func (u UDF) Required() bool {
+	return !u.HasDefault
+}
+
+// Tag returns the declaration of the field as Linode expects it in the script body. Linode's
+// parser knows no escapes, so attributes are quoted as they are; tagError tells whether that works.
+func (u UDF) Tag() string {
+	tag := fmt.Sprintf(`# <UDF name="%s" label="%s"`, u.Name, u.Label)
+	if u.HasDefault {
+		tag += fmt.Sprintf(` default="%s"`, u.Default)
+	}
+	if u.Example != "" {
+		tag += fmt.Sprintf(` example="%s"`, u.Example)
+	}
+	if len(u.OneOf) > 0 {
+		tag += fmt.Sprintf(` oneof="%s"`, strings.Join(u.OneOf, ","))
+	}
+	if len(u.ManyOf) > 0 {
+		tag += fmt.Sprintf(` manyof="%s"`, strings.Join(u.ManyOf, ","))
+	}
+	return tag + " />"
+}
+
+// tagError returns why Tag can't declare the UDF, or nil: an attribute containing '"' would end
+// its quotes early.
+func (u UDF) tagError() error {
+	attrs := []string{u.Label, u.Default, u.Example, strings.Join(u.OneOf, ","), strings.Join(u.ManyOf, ",")}
+	for _, a := range attrs {
+		if strings.Contains(a, `"`) {
+			return fmt.Errorf("UDF %s: %q contains '\"', which can't be quoted in a tag", u.Name, a)
+		}
+	}
+	return nil
+}
+
+// check returns why value is not acceptable for the UDF, or "".
+func (u UDF) check(value string) string {
+	switch u.Type() {
+	case UDFTypeSelect:
+		if !containsString(u.OneOf, value) {
+			return fmt.Sprintf("%q is not one of %s", value, strings.Join(u.OneOf, ", "))
+		}
+	case UDFTypeMultiSelect:
+		for _, v := range strings.Split(value, ",") {
+			if !containsString(u.ManyOf, v) {
+				return fmt.Sprintf("%q is not one of %s", v, strings.Join(u.ManyOf, ", "))
+			}
+		}
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return "must be a single line"
+	}
+	return ""
+}
+
+var (
+	// A '>' only ends a tag outside of quotes.
+	udfTagRegexp  = regexp.MustCompile(`(?i)<UDF\s((?:[^>"']|"[^"]*"|'[^']*')*?)/?>`)
+	udfAttrRegexp = regexp.MustCompile(`([a-zA-Z_]+)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+)
+
+// parseUDFs extracts the UDF declarations of a StackScript body. Attribute names are not case
+// sensitive, as in Linode's own parser.
+func parseUDFs(body string) ([]UDF, error) {
+	var udfs []UDF
+	for _, m := range udfTagRegexp.FindAllStringSubmatch(body, -1) {
+		u := UDF{}
+		for _, a := range udfAttrRegexp.FindAllStringSubmatch(m[1], -1) {
+			value := a[2] + a[3]
+			switch strings.ToLower(a[1]) {
+			case "name":
+				u.Name = value
+			case "label":
+				u.Label = value
+			case "default":
+				u.Default, u.HasDefault = value, true
+			case "example":
+				u.Example = value
+			case "oneof":
+				u.OneOf = strings.Split(value, ",")
+			case "manyof":
+				u.ManyOf = strings.Split(value, ",")
+			default:
+				return nil, fmt.Errorf("%s: unknown UDF attribute %q", m[0], a[1])
+			}
+		}
+		switch {
+		case !udfNameRegexp.MatchString(u.Name):
+			return nil, fmt.Errorf("%s: invalid UDF name %q", m[0], u.Name)
+		case len(u.OneOf) > 0 && len(u.ManyOf) > 0:
+			return nil, fmt.Errorf("%s: oneof and manyof can't be combined", m[0])
+		case u.HasDefault && u.Default != "" && u.check(u.Default) != "":
+			return nil, fmt.Errorf("%s: default %s", m[0], u.check(u.Default))
+		}
+		for _, d := range udfs {
+			if d.Name == u.Name {
+				return nil, fmt.Errorf("UDF %s is declared twice", u.Name)
+			}
+		}
+		udfs = append(udfs, u)
+	}
+	return udfs, nil
+}
+
+// validateUDFResponses checks r against the UDFs a script declares: every response must belong to a
+// declared UDF and be an allowed value, and every required UDF needs a response. The UDFs listed in
+// pending are filled in later, so they are not required yet.
+func validateUDFResponses(udfs []UDF, r UDFResponses, pending ...string) error {
+	var msgs []string
+	declared := map[string]UDF{}
+	for _, u := range udfs {
+		declared[u.Name] = u
+		if _, ok := r[u.Name]; !ok && u.Required() && !containsString(pending, u.Name) {
+			msgs = append(msgs, fmt.Sprintf("%s: is required", u.Name))
+		}
+	}
+	var names []string
+	for name := range r {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		u, ok := declared[name]
+		if !ok {
+			msgs = append(msgs, fmt.Sprintf("%s: is not declared by the StackScript", name))
+			continue
+		}
+		if problem := u.check(r[name]); problem != "" {
+			msgs = append(msgs, fmt.Sprintf("%s: %s", name, problem))
+		}
+	}
+	if len(msgs) > 0 {
+		return fmt.Errorf("invalid StackScript UDF responses:\n  %s", strings.Join(msgs, "\n  "))
+	}
+	return nil
+}
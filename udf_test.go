@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseUDFs(t *testing.T) {
+	body := `#!/bin/bash
+# <UDF name="hostname" label="Node hostname" />
+# <udf NAME='greeting' Label="Say <hi> > there" default='a "quoted" word'/>
+# <UDF name="size" label="Size" oneof="small,large" default="small" example="large">
+`
+	udfs, err := parseUDFs(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []UDF{
+		{Name: "hostname", Label: "Node hostname"},
+		{Name: "greeting", Label: "Say <hi> > there", Default: `a "quoted" word`, HasDefault: true},
+		{Name: "size", Label: "Size", Default: "small", HasDefault: true, Example: "large", OneOf: []string{"small", "large"}},
+	}
+	if !reflect.DeepEqual(udfs, want) {
+		t.Errorf("parseUDFs() = %+v, want %+v", udfs, want)
+	}
+}
+
+func TestParseUDFsErrors(t *testing.T) {
+	tests := []struct {
+		body, err string
+	}{
+		{`<UDF name="a" label="A" colour="red" />`, "unknown UDF attribute"},
+		{`<UDF name="1a" label="A" />`, "invalid UDF name"},
+		{`<UDF name="a" oneof="x,y" manyof="x" />`, "can't be combined"},
+		{`<UDF name="a" oneof="x,y" default="z" />`, "is not one of"},
+		{`<UDF name="a" /> <UDF name="a" />`, "declared twice"},
+	}
+	for _, test := range tests {
+		_, err := parseUDFs(test.body)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("parseUDFs(%s) = %v, want an error containing %q", test.body, err, test.err)
+		}
+	}
+}
+
+func TestUDFTagRoundTrip(t *testing.T) {
+	udfs := []UDF{
+		{Name: "hostname", Label: "Node hostname"},
+		{Name: "role", Label: "Role of the node", HasDefault: true},
+		{Name: "greeting", Label: "Say <hi> & 'bye' > then", Default: `back\slash`, HasDefault: true, Example: "hello"},
+		{Name: "size", Label: "Size", OneOf: []string{"small", "large"}, Default: "large", HasDefault: true},
+		{Name: "addons", Label: "Add-ons", ManyOf: []string{"dns", "dashboard"}},
+	}
+	for _, u := range udfs {
+		if err := u.tagError(); err != nil {
+			t.Errorf("%s.tagError() = %v", u.Name, err)
+			continue
+		}
+		parsed, err := parseUDFs(u.Tag())
+		if err != nil {
+			t.Errorf("parseUDFs(%s) failed: %v", u.Tag(), err)
+			continue
+		}
+		if len(parsed) != 1 || !reflect.DeepEqual(parsed[0], u) {
+			t.Errorf("parseUDFs(%s) = %+v, want %+v", u.Tag(), parsed, u)
+		}
+	}
+}
+
+func TestUDFTagError(t *testing.T) {
+	for _, u := range []UDF{
+		{Name: "a", Label: `say "hi"`},
+		{Name: "a", Label: "A", Default: `"`, HasDefault: true},
+		{Name: "a", Label: "A", OneOf: []string{`x"`, "y"}},
+	} {
+		if err := u.tagError(); err == nil {
+			t.Errorf("%+v.tagError() = nil, want an error", u)
+		}
+	}
+}